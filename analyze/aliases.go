@@ -0,0 +1,122 @@
+package analyze
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/ngrash/tgstat/tgexport"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Aliases maps sender names to the names they are replaced with.
+type Aliases map[tgexport.Sender]tgexport.Sender
+
+// LoadAliases reads a JSON object of sender names and aliases.
+func LoadAliases(path string) (Aliases, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var a Aliases
+	if err := json.Unmarshal(buf, &a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// LoadAliasFiles reads the aliases of all files at paths and merges them in
+// order. Aliases of later files replace those of earlier files for the same sender.
+// Files that do not exist are skipped and returned as missing, so that they do
+// not discard the aliases of the other files.
+func LoadAliasFiles(paths []string) (Aliases, []string, error) {
+	merged := Aliases{}
+	var missing []string
+	for _, path := range paths {
+		aliases, err := LoadAliases(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			missing = append(missing, path)
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", path, err)
+		}
+		maps.Copy(merged, aliases)
+	}
+	return merged, missing, nil
+}
+
+// AliasPattern replaces all sender names matching Pattern with Alias.
+type AliasPattern struct {
+	Pattern *regexp.Regexp
+	Alias   tgexport.Sender
+}
+
+// LoadAliasPatterns reads a JSON object of patterns and aliases.
+// The order of the keys is preserved, as the first matching pattern wins.
+// Patterns must match the whole sender name.
+func LoadAliasPatterns(path string) ([]AliasPattern, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Maps lose the order of keys, so the object is read token by token.
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	if tok, err := dec.Token(); err != nil {
+		return nil, err
+	} else if tok != json.Delim('{') {
+		return nil, fmt.Errorf("want object, got %v", tok)
+	}
+	var patterns []AliasPattern
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key := tok.(string) // object keys are always strings
+		var alias tgexport.Sender
+		if err := dec.Decode(&alias); err != nil {
+			return nil, fmt.Errorf("alias for %q: %w", key, err)
+		}
+		pattern, err := regexp.Compile(`^(?:` + key + `)$`)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, AliasPattern{pattern, alias})
+	}
+	return patterns, nil
+}
+
+// applySenderAlias replaces the sender of msg by its alias. Exact aliases are
+// tried first, then the patterns in order.
+func applySenderAlias(msg *tgexport.Message, aliases Aliases, patterns []AliasPattern) {
+	if alias, replace := aliases[msg.From]; replace {
+		msg.From = alias
+		return
+	}
+	for _, p := range patterns {
+		if p.Pattern.MatchString(string(msg.From)) {
+			msg.From = p.Alias
+			return
+		}
+	}
+}
+
+// normalizeSender converts the sender to Unicode normalization form NFC and
+// trims it, so that "Bob " and "Bob" as well as a composed "é" and an "e"
+// with combining accent are the same sender. With collapse, runs of
+// whitespace within the sender are collapsed into a single space as well.
+func normalizeSender(s tgexport.Sender, collapse bool) tgexport.Sender {
+	name := strings.TrimSpace(norm.NFC.String(string(s)))
+	if collapse {
+		name = strings.Join(strings.Fields(name), " ")
+	}
+	return tgexport.Sender(name)
+}
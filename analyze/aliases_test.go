@@ -0,0 +1,75 @@
+package analyze
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/ngrash/tgstat/tgexport"
+)
+
+func TestLoadAliasFiles(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.json")
+	second := filepath.Join(dir, "second.json")
+	if err := os.WriteFile(first, []byte(`{"Bobby": "Bob", "Al": "Alice"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(second, []byte(`{"Bobby": "Robert", "Caro": "Carol"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing.json")
+
+	got, gotMissing, err := LoadAliasFiles([]string{first, missing, second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{missing}, gotMissing); diff != "" {
+		t.Errorf("missing diff -want +got:\n%s", diff)
+	}
+	want := Aliases{
+		"Bobby": "Robert", // overridden by the second file
+		"Al":    "Alice",
+		"Caro":  "Carol",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
+
+func TestApplySenderAliasPatterns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "alias-patterns.json")
+	err := os.WriteFile(path, []byte(`{
+		"Bob.*": "Bob",
+		".*": "Someone"
+	}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patterns, err := LoadAliasPatterns(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliases := Aliases{"Bobby": "Robert"}
+
+	for from, want := range map[tgexport.Sender]tgexport.Sender{
+		"Bobby":     "Robert", // exact aliases win
+		"Bob (old)": "Bob",
+		"Bob":       "Bob",
+		"Jim Bob":   "Someone", // patterns match the whole name
+	} {
+		msg := tgexport.Message{From: from}
+		applySenderAlias(&msg, aliases, patterns)
+		if msg.From != want {
+			t.Errorf("%q: got %q, want %q", from, msg.From, want)
+		}
+	}
+
+	msg := tgexport.Message{From: "Bobby"}
+	applySenderAlias(&msg, nil, patterns)
+	if msg.From != "Bob" {
+		t.Errorf("got %q, want %q", msg.From, "Bob")
+	}
+}
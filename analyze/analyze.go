@@ -0,0 +1,715 @@
+// Package analyze computes metrics from Telegram chat exports.
+package analyze
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ngrash/tgstat/backfill"
+	"github.com/ngrash/tgstat/tgexport"
+)
+
+// MetricsPrefix is the common prefix of all metric names,
+// unless Options.MetricsPrefix is set.
+const MetricsPrefix = "tg_"
+
+// AnonymousSender is the sender of messages without sender, e.g. posts of
+// anonymous admins, with Options.IncludeAnonymous.
+const AnonymousSender tgexport.Sender = "<anonymous>"
+
+// Names of the recorded metrics.
+const (
+	MessagesTotal      = MetricsPrefix + "messages_total"
+	ChatMessagesTotal  = MetricsPrefix + "chat_messages_total"
+	TextMessagesTotal  = MetricsPrefix + "text_messages_total"
+	CaptionsTotal      = MetricsPrefix + "captions_total"
+	EmojiMessagesTotal = MetricsPrefix + "emoji_messages_total"
+	SelfMessagesTotal  = MetricsPrefix + "self_messages_total"
+	ExpressionsTotal   = MetricsPrefix + "expressions_total"
+	BytesTotal         = MetricsPrefix + "bytes_total"
+	WordsTotal         = MetricsPrefix + "words_total"
+	RunesTotal         = MetricsPrefix + "runes_total"
+	MediaTotal         = MetricsPrefix + "media_total"
+	MediaBytesTotal    = MetricsPrefix + "media_bytes_total"
+	VoiceSecondsTotal  = MetricsPrefix + "voice_seconds_total"
+	VideoSecondsTotal  = MetricsPrefix + "video_seconds_total"
+	ReactionsTotal     = MetricsPrefix + "reactions_total"
+	RepliesTotal       = MetricsPrefix + "replies_total"
+	ForwardsTotal      = MetricsPrefix + "forwards_total"
+	PollsTotal         = MetricsPrefix + "polls_total"
+	EditsTotal         = MetricsPrefix + "edits_total"
+	PollVotesTotal     = MetricsPrefix + "poll_votes_total"
+	MentionsTotal      = MetricsPrefix + "mentions_total"
+	HashtagsTotal      = MetricsPrefix + "hashtags_total"
+	LinksTotal         = MetricsPrefix + "links_total"
+
+	FormattingEntitiesTotal = MetricsPrefix + "formatting_entities_total"
+
+	MessagesByWeekdayTotal = MetricsPrefix + "messages_by_weekday_total"
+	MessagesByHourTotal    = MetricsPrefix + "messages_by_hour_total"
+	MessagesByMonthTotal   = MetricsPrefix + "messages_by_month_total"
+	MessagesPerBucket      = MetricsPrefix + "messages_per_bucket"
+
+	ActiveSenders = MetricsPrefix + "active_senders"
+
+	MessageLength        = MetricsPrefix + "message_length"
+	MessageLengthSummary = MetricsPrefix + "message_length_summary"
+	SenderGapSeconds     = MetricsPrefix + "sender_gap_seconds"
+	ReplyLatencySeconds  = MetricsPrefix + "reply_latency_seconds"
+
+	SenderFirstSeenTimestamp = MetricsPrefix + "sender_first_seen_timestamp"
+	SenderLastSeenTimestamp  = MetricsPrefix + "sender_last_seen_timestamp"
+	SenderActiveDaysTotal    = MetricsPrefix + "sender_active_days_total"
+	SenderMaxMessageRunes    = MetricsPrefix + "sender_max_message_runes"
+)
+
+// descriptions are the types and help texts of the recorded metrics.
+var descriptions = []struct {
+	name string
+	typ  backfill.MetricType
+	help string
+}{
+	{MessagesTotal, backfill.Counter, "Number of messages by sender."},
+	{ChatMessagesTotal, backfill.Counter, "Number of messages by chat, including messages without sender."},
+	{TextMessagesTotal, backfill.Counter, "Number of messages with text and without media by sender."},
+	{CaptionsTotal, backfill.Counter, "Number of media messages with a caption by sender."},
+	{EmojiMessagesTotal, backfill.Counter, "Number of text messages with nothing but emoji by sender."},
+	{SelfMessagesTotal, backfill.Counter, "Number of messages sent by the account that exported the chats."},
+	{ExpressionsTotal, backfill.Counter, "Number of matches of expressions in messages by sender."},
+	{BytesTotal, backfill.Counter, "Number of bytes of message texts by sender."},
+	{WordsTotal, backfill.Counter, "Number of words of message texts by sender."},
+	{RunesTotal, backfill.Counter, "Number of characters of message texts by sender."},
+	{MediaTotal, backfill.Counter, "Number of media messages by sender and media type."},
+	{MediaBytesTotal, backfill.Counter, "Size of attached media in bytes by sender and media type."},
+	{VoiceSecondsTotal, backfill.Counter, "Duration of voice messages in seconds by sender."},
+	{VideoSecondsTotal, backfill.Counter, "Duration of video messages in seconds by sender."},
+	{ReactionsTotal, backfill.Counter, "Number of reactions to messages by sender and emoji."},
+	{RepliesTotal, backfill.Counter, "Number of replies by sender."},
+	{ForwardsTotal, backfill.Counter, "Number of forwarded messages by sender and source."},
+	{PollsTotal, backfill.Counter, "Number of polls by sender."},
+	{EditsTotal, backfill.Counter, "Number of edited messages by sender."},
+	{PollVotesTotal, backfill.Counter, "Number of votes by poll question and answer."},
+	{MentionsTotal, backfill.Counter, "Number of mentions of users by sender and mentioned user."},
+	{HashtagsTotal, backfill.Counter, "Number of hashtags by sender and hashtag."},
+	{LinksTotal, backfill.Counter, "Number of links by sender."},
+	{FormattingEntitiesTotal, backfill.Counter, "Number of formatted text entities, e.g. bold text or links, by sender and type."},
+	{MessagesByWeekdayTotal, backfill.Counter, "Number of messages by sender and weekday."},
+	{MessagesByHourTotal, backfill.Counter, "Number of messages by sender and hour of the day."},
+	{MessagesByMonthTotal, backfill.Counter, "Number of messages by sender and calendar month."},
+	{MessagesPerBucket, backfill.Gauge, "Number of messages per resolution step by sender."},
+	{ActiveSenders, backfill.Gauge, "Number of distinct senders per resolution step."},
+	{MessageLength, backfill.Histogram, "Length of message texts in characters by sender."},
+	{MessageLengthSummary, backfill.Summary, "Quantiles of the length of message texts in characters by sender."},
+	{SenderMaxMessageRunes, backfill.Gauge, "Length of the longest message by sender in runes."},
+	{SenderGapSeconds, backfill.Histogram, "Time between consecutive messages by sender in seconds."},
+	{ReplyLatencySeconds, backfill.Histogram, "Time between messages and their first reply by replying sender in seconds."},
+	{SenderFirstSeenTimestamp, backfill.Gauge, "Unix time of the first message by sender."},
+	{SenderLastSeenTimestamp, backfill.Gauge, "Unix time of the latest message by sender."},
+	{SenderActiveDaysTotal, backfill.Gauge, "Number of distinct days with messages by sender."},
+}
+
+// Options configures the analysis of chats. The zero value analyzes all
+// messages without aliases and expressions.
+type Options struct {
+	// Expressions are counted in message texts.
+	Expressions []Expression
+
+	// Aliases and AliasPatterns replace sender names before messages are analyzed.
+	Aliases       Aliases
+	AliasPatterns []AliasPattern
+
+	// ExcludeSenders are not analyzed at all, e.g. bots or deleted accounts.
+	// They are compared with the sender names after aliases were applied.
+	ExcludeSenders []tgexport.Sender
+
+	// MessageLengthBuckets are the upper bounds of the tg_message_length histogram.
+	MessageLengthBuckets []float64
+
+	// MessageLengthQuantiles are the quantiles of the tg_message_length_summary
+	// summary, e.g. 0.5 for the median. The summary is not recorded without them.
+	MessageLengthQuantiles []float64
+
+	// SenderGapBuckets are the upper bounds of the tg_sender_gap_seconds histogram.
+	SenderGapBuckets []float64
+
+	// ReplyLatencyBuckets are the upper bounds of the tg_reply_latency_seconds histogram.
+	ReplyLatencyBuckets []float64
+
+	// MetricsPrefix replaces the MetricsPrefix of all metric names, e.g. to
+	// distinguish the metrics of different users in the same database.
+	// It defaults to MetricsPrefix.
+	MetricsPrefix string
+
+	// ChatName is added as chat label to all metrics, if not empty.
+	// AnalyzeFile prefers the names of the chats in the export and uses
+	// ChatName only for chats without name.
+	ChatName string
+
+	// ChatType is added as chat_type label to all metrics, if not empty.
+	// AnalyzeFile uses the types of the chats in the export instead.
+	ChatType string
+
+	// Self is the account that exported the chats. Its messages are counted
+	// in tg_self_messages_total, if not nil. AnalyzeFile uses the personal
+	// information of the export instead, if it has any.
+	Self *tgexport.PersonalInformation
+
+	// ChatTypes restricts the analysis to chats of these types, e.g.
+	// private_group. Empty ChatTypes do not restrict the analysis.
+	ChatTypes []string
+
+	// IncludeAnonymous counts messages without sender as sent by
+	// AnonymousSender instead of skipping them.
+	IncludeAnonymous bool
+
+	// AttributeSenderless counts messages without sender in channels as
+	// sent by the channel, with the chat name as sender and sender_type
+	// channel, and in Saved Messages as sent by Self, if known.
+	AttributeSenderless bool
+
+	// NormalizeSenders converts senders to Unicode normalization form NFC
+	// and trims them after aliases are applied.
+	NormalizeSenders bool
+
+	// CollapseWhitespace additionally collapses runs of whitespace
+	// within senders into a single space, if NormalizeSenders is set.
+	CollapseWhitespace bool
+
+	// Stats counts the analyzed messages, if not nil.
+	Stats *Stats
+
+	// Dedup skips messages that were analyzed before, if not nil.
+	Dedup *Dedup
+
+	// Since and Until restrict the analysis to messages sent in [Since, Until).
+	// Zero values do not restrict the analysis.
+	Since, Until time.Time
+
+	// LimitMessages stops the analysis of an export after its first
+	// LimitMessages messages, including service messages, if not zero.
+	// The metrics are then a sample of the export, e.g. to try options
+	// quickly. The limit applies to all chats of a full export together.
+	LimitMessages int
+}
+
+// errLimitReached stops reading an export at Options.LimitMessages.
+var errLimitReached = errors.New("message limit reached")
+
+// Analyze records the metrics of all messages of the chat export in metrics.
+// It stops with the error of ctx if ctx is done.
+func Analyze(ctx context.Context, data *tgexport.Result, metrics *backfill.Metrics, opts Options) error {
+	a := newAnalyzer(metrics, opts)
+	for i, msg := range data.Messages {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if opts.LimitMessages > 0 && i >= opts.LimitMessages {
+			break
+		}
+		a.analyzeMessage(msg)
+	}
+	a.finish()
+	return nil
+}
+
+// AnalyzeFile is like Analyze, but reads the messages of the export
+// at path one by one, so that large exports do not have to fit into memory.
+// The metrics of each chat are labeled with the name of the chat.
+func AnalyzeFile(ctx context.Context, path string, metrics *backfill.Metrics, opts Options) error {
+	return analyzeStream(ctx, metrics, opts, func(fn func(*tgexport.Chat, tgexport.Message) error) error {
+		return tgexport.ReadFullExportStream(path, fn)
+	})
+}
+
+// AnalyzeReader is like AnalyzeFile, but reads the export from r, e.g. from stdin.
+func AnalyzeReader(ctx context.Context, r io.Reader, metrics *backfill.Metrics, opts Options) error {
+	return analyzeStream(ctx, metrics, opts, func(fn func(*tgexport.Chat, tgexport.Message) error) error {
+		return tgexport.ReadStream(r, fn)
+	})
+}
+
+// analyzeStream analyzes the messages that read passes to its callback.
+func analyzeStream(ctx context.Context, metrics *backfill.Metrics, opts Options, read func(func(*tgexport.Chat, tgexport.Message) error) error) error {
+	// Chats of full exports are analyzed separately, keyed by chat name.
+	analyzers := map[string]*analyzer{}
+	var count int
+	err := read(func(chat *tgexport.Chat, msg tgexport.Message) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if opts.LimitMessages > 0 && count >= opts.LimitMessages {
+			return errLimitReached
+		}
+		count++
+		chatOpts := opts
+		if chat.Name != "" {
+			chatOpts.ChatName = chat.Name
+		}
+		chatOpts.ChatType = chat.Type
+		if chat.Self != nil {
+			chatOpts.Self = chat.Self
+		}
+		a, ok := analyzers[chatOpts.ChatName]
+		if !ok {
+			a = newAnalyzer(metrics, chatOpts)
+			analyzers[chatOpts.ChatName] = a
+		}
+		a.analyzeMessage(msg)
+		return nil
+	})
+	if err != nil && !errors.Is(err, errLimitReached) {
+		return err
+	}
+	for _, a := range analyzers {
+		a.finish()
+	}
+	return nil
+}
+
+// analyzer holds the state of the analysis of a single chat export.
+// Most metrics are recorded per message, but some need to know all messages.
+type analyzer struct {
+	metrics *backfill.Metrics
+	opts    Options
+
+	// firstSeen is the time of the first message by sender.
+	firstSeen map[tgexport.Sender]time.Time
+
+	// lastSeen is the time of the previous message by sender.
+	lastSeen map[tgexport.Sender]time.Time
+
+	// activeDays are the times of the first message by sender on each day
+	// with messages, in the time zone of the message dates.
+	activeDays map[tgexport.Sender]map[civilDay]time.Time
+
+	// topics is the name of the forum topic by message ID. It is empty
+	// until the first topic is created, i.e. in chats without topics.
+	topics map[int64]string
+
+	// topicRoots are the IDs of the messages that created topics.
+	topicRoots map[int64]bool
+
+	// posts are the messages that may be replied to, by ID. Messages are
+	// removed once they are replied to, as only the first reply counts.
+	posts map[int64]*post
+
+	// senderTypes are the sender_type labels by sender, as of their first message.
+	senderTypes map[tgexport.Sender]string
+
+	// longest are the messages by sender that were the longest up to their
+	// time, in time order.
+	longest map[tgexport.Sender][]longest
+
+	// counted reports whether a message of the chat was analyzed.
+	counted bool
+}
+
+// longest is the length of a message in runes at its time.
+type longest struct {
+	at    time.Time
+	runes int
+}
+
+// addLongest adds l to s, the messages that were the longest up to their time,
+// if it is longer than the messages before it. Messages after it that are not
+// longer are removed.
+func addLongest(s []longest, l longest) []longest {
+	i, _ := slices.BinarySearchFunc(s, l.at, func(e longest, at time.Time) int {
+		return e.at.Compare(at)
+	})
+	if i > 0 && s[i-1].runes >= l.runes || i < len(s) && s[i].at.Equal(l.at) && s[i].runes >= l.runes {
+		return s
+	}
+	j := i
+	for j < len(s) && s[j].runes <= l.runes {
+		j++
+	}
+	return slices.Replace(s, i, j, l)
+}
+
+// post is a message that may be replied to.
+type post struct {
+	from tgexport.Sender // before aliases are applied
+	at   time.Time
+}
+
+func newAnalyzer(metrics *backfill.Metrics, opts Options) *analyzer {
+	if opts.ChatName != "" {
+		metrics = metrics.With("chat", opts.ChatName)
+	}
+	if opts.ChatType != "" {
+		metrics = metrics.With("chat_type", opts.ChatType)
+	}
+	a := &analyzer{
+		metrics:    metrics,
+		opts:       opts,
+		firstSeen:  make(map[tgexport.Sender]time.Time),
+		lastSeen:   make(map[tgexport.Sender]time.Time),
+		activeDays: make(map[tgexport.Sender]map[civilDay]time.Time),
+		topics:     make(map[int64]string),
+		topicRoots: make(map[int64]bool),
+		posts:      make(map[int64]*post),
+
+		senderTypes: make(map[tgexport.Sender]string),
+		longest:     make(map[tgexport.Sender][]longest),
+	}
+	for _, d := range descriptions {
+		metrics.Metric(a.name(d.name)).Describe(d.typ, d.help)
+	}
+	return a
+}
+
+// countChatMessage counts an analyzed message towards the chat. The chat
+// is recorded in Stats with its first analyzed message, so that chats that
+// are skipped entirely, e.g. with ChatTypes, are not.
+func (a *analyzer) countChatMessage(date time.Time) {
+	a.metrics.Metric(a.name(ChatMessagesTotal)).Inc(1, date)
+	if !a.counted && a.opts.Stats != nil && a.opts.ChatName != "" {
+		a.opts.Stats.addChat(a.opts.ChatName)
+	}
+	a.counted = true
+}
+
+// name returns the name of the metric with the configured prefix.
+func (a *analyzer) name(metric string) string {
+	if a.opts.MetricsPrefix == "" {
+		return metric
+	}
+	return a.opts.MetricsPrefix + strings.TrimPrefix(metric, MetricsPrefix)
+}
+
+// isSelf reports whether msg was sent by the account that exported the chat.
+// Messages are matched by the ID of their sender, or by name if they have none.
+func (a *analyzer) isSelf(msg tgexport.Message) bool {
+	if a.opts.Self == nil {
+		return false
+	}
+	if msg.FromID != "" {
+		return msg.FromID == a.opts.Self.SenderID()
+	}
+	return msg.From == a.opts.Self.Name()
+}
+
+// senderlessSender returns the sender of a message without sender with
+// Options.AttributeSenderless, or an empty string if the chat has none.
+func (a *analyzer) senderlessSender() tgexport.Sender {
+	switch a.opts.ChatType {
+	case "public_channel", "private_channel":
+		sender := tgexport.Sender(a.opts.ChatName)
+		if _, ok := a.senderTypes[sender]; !ok && sender != "" {
+			a.senderTypes[sender] = "channel"
+		}
+		return sender
+	case "saved_messages":
+		if a.opts.Self != nil {
+			return a.opts.Self.Name()
+		}
+	}
+	return ""
+}
+
+// senderMetrics returns the metrics labeled with sender, and with its
+// sender_type if known.
+func (a *analyzer) senderMetrics(sender tgexport.Sender) *backfill.Metrics {
+	metrics := a.metrics.With("sender", string(sender))
+	if typ := a.senderTypes[sender]; typ != "" {
+		metrics = metrics.With("sender_type", typ)
+	}
+	return metrics
+}
+
+// senderTypes are the values of the sender_type label by prefix of the sender ID.
+var senderTypes = map[string]string{
+	"user":    "user",
+	"bot":     "bot",
+	"channel": "channel",
+	"chat":    "group",
+	"group":   "group",
+}
+
+// senderType returns the type of the sender with the given ID, e.g. "channel"
+// for "channel123", or an empty string if unknown. Telegram exports bots with
+// the prefix of users, so only IDs with an explicit bot prefix are bots.
+func senderType(id string) string {
+	prefix := strings.TrimRight(id, "0123456789")
+	if prefix == id {
+		return ""
+	}
+	return senderTypes[prefix]
+}
+
+// civilDay is a calendar day, independent of time zones.
+type civilDay struct {
+	year  int
+	month time.Month
+	day   int
+}
+
+// newCivilDay returns the day of t in the location of t.
+func newCivilDay(t time.Time) civilDay {
+	year, month, day := t.Date()
+	return civilDay{year, month, day}
+}
+
+// generalTopic is the topic of messages in forum groups that are not in a
+// created topic, like the General topic of Telegram.
+const generalTopic = "general"
+
+// topic returns the forum topic of msg, or an empty string in chats without
+// topics. Messages in a topic reply to the message that created the topic,
+// or to another message in the topic. Topics are remembered by message ID,
+// so that replies are resolved to the topic of the message they reply to.
+func (a *analyzer) topic(msg tgexport.Message) string {
+	if msg.Action == "topic_created" {
+		a.topics[msg.ID] = msg.Title
+		a.topicRoots[msg.ID] = true
+		return msg.Title
+	}
+	if len(a.topics) == 0 {
+		return ""
+	}
+	topic, ok := a.topics[msg.ReplyToID]
+	if !ok {
+		topic = generalTopic
+	}
+	if msg.ID != 0 {
+		a.topics[msg.ID] = topic
+	}
+	return topic
+}
+
+// finish records the metrics that need to know all messages.
+func (a *analyzer) finish() {
+	for sender, first := range a.firstSeen {
+		// Other analyzers may record an earlier first message to the same series.
+		a.senderMetrics(sender).Metric(a.name(SenderFirstSeenTimestamp)).Min(uint64(first.Unix()), first)
+	}
+	for sender, longest := range a.longest {
+		maxRunes := a.senderMetrics(sender).Metric(a.name(SenderMaxMessageRunes))
+		for _, l := range longest {
+			maxRunes.Max(uint64(l.runes), l.at)
+		}
+	}
+	// Days are counted once all messages are known, as they may be out of order.
+	for sender, days := range a.activeDays {
+		activeDays := a.senderMetrics(sender).Metric(a.name(SenderActiveDaysTotal))
+		for _, first := range days {
+			activeDays.DistinctTotal(first.Format(time.DateOnly), first)
+		}
+	}
+}
+
+func (a *analyzer) analyzeMessage(msg tgexport.Message) {
+	// Topics are tracked for all messages, as skipped messages may be replied to.
+	topic := a.topic(msg)
+	if msg.Type == "service" {
+		return
+	}
+	if a.opts.Dedup != nil && a.opts.Dedup.seenBefore(a.opts.ChatName, msg.ID) {
+		return
+	}
+	if len(a.opts.ChatTypes) > 0 && !slices.Contains(a.opts.ChatTypes, a.opts.ChatType) {
+		return
+	}
+	date := time.Time(msg.Date)
+	// Messages before Since may still be replied to within the time range.
+	from := msg.From
+	if msg.ID != 0 {
+		a.posts[msg.ID] = &post{from: from, at: date}
+	}
+	if !a.opts.Since.IsZero() && date.Before(a.opts.Since) || !a.opts.Until.IsZero() && !date.Before(a.opts.Until) {
+		return
+	}
+	if msg.From == "" && a.opts.AttributeSenderless {
+		msg.From = a.senderlessSender()
+	}
+	if msg.From == "" && a.opts.IncludeAnonymous {
+		msg.From = AnonymousSender
+	}
+	if msg.From == "" {
+		// Messages without sender count towards the chat, but no sender.
+		a.countChatMessage(date)
+		return
+	}
+	// Senders are compared with the account before aliases are applied.
+	self := a.isSelf(msg)
+	applySenderAlias(&msg, a.opts.Aliases, a.opts.AliasPatterns)
+	if a.opts.NormalizeSenders {
+		msg.From = normalizeSender(msg.From, a.opts.CollapseWhitespace)
+	}
+	if slices.Contains(a.opts.ExcludeSenders, msg.From) {
+		return
+	}
+	a.countChatMessage(date)
+	if self {
+		a.metrics.Metric(a.name(SelfMessagesTotal)).Inc(1, date)
+	}
+	if a.opts.Stats != nil {
+		a.opts.Stats.add(msg.From, date)
+	}
+	a.metrics.Metric(a.name(ActiveSenders)).Distinct(string(msg.From), date)
+	if _, ok := a.senderTypes[msg.From]; !ok {
+		a.senderTypes[msg.From] = senderType(msg.FromID)
+	}
+	senderMetrics := a.senderMetrics(msg.From)
+
+	if first, ok := a.firstSeen[msg.From]; !ok || date.Before(first) {
+		a.firstSeen[msg.From] = date
+	}
+	// Exports are ordered by time, so out of order messages are not observed.
+	if last, ok := a.lastSeen[msg.From]; !ok || !date.Before(last) {
+		if ok {
+			gap := date.Sub(last).Seconds()
+			senderMetrics.Metric(a.name(SenderGapSeconds)).Buckets(a.opts.SenderGapBuckets...).Observe(gap, date)
+		}
+		a.lastSeen[msg.From] = date
+	}
+	// The last seen time at any point is the time of the latest message until then.
+	senderMetrics.Metric(a.name(SenderLastSeenTimestamp)).Set(uint64(date.Unix()), date)
+	if days := a.activeDays[msg.From]; days == nil {
+		a.activeDays[msg.From] = map[civilDay]time.Time{}
+	}
+	if day := newCivilDay(date); a.activeDays[msg.From][day].IsZero() || date.Before(a.activeDays[msg.From][day]) {
+		a.activeDays[msg.From][day] = date
+	}
+
+	messages := senderMetrics.Metric(a.name(MessagesTotal))
+	if topic != "" {
+		messages = messages.With("topic", topic)
+	}
+	messages.Inc(1, date)
+	senderMetrics.Metric(a.name(MessagesPerBucket)).IncPerStep(1, date)
+	senderMetrics.Metric(a.name(MessagesByWeekdayTotal)).With("weekday", date.Weekday().String()[:3]).Inc(1, date)
+	senderMetrics.Metric(a.name(MessagesByHourTotal)).With("hour", fmt.Sprintf("%02d", date.Hour())).Inc(1, date)
+	senderMetrics.Metric(a.name(MessagesByMonthTotal)).With("month", date.Format("2006-01")).Inc(1, date)
+	if msg.MediaType != "" {
+		senderMetrics.Metric(a.name(MediaTotal)).With("media_type", msg.MediaType).Inc(1, date)
+		if msg.FileSize > 0 {
+			senderMetrics.Metric(a.name(MediaBytesTotal)).With("media_type", msg.MediaType).Inc(uint64(msg.FileSize), date)
+		}
+		if msg.DurationSeconds > 0 {
+			switch msg.MediaType {
+			case "voice_message":
+				senderMetrics.Metric(a.name(VoiceSecondsTotal)).Inc(uint64(msg.DurationSeconds), date)
+			case "video_message":
+				senderMetrics.Metric(a.name(VideoSecondsTotal)).Inc(uint64(msg.DurationSeconds), date)
+			}
+		}
+	}
+	if msg.Edited != nil {
+		senderMetrics.Metric(a.name(EditsTotal)).Inc(1, date)
+	}
+	// Messages in forum topics reply to the message that created the topic.
+	if msg.ReplyToID != 0 && !a.topicRoots[msg.ReplyToID] {
+		senderMetrics.Metric(a.name(RepliesTotal)).Inc(1, date)
+		// Replies to messages that are not in the export are skipped,
+		// as are senders who reply to themselves.
+		if p := a.posts[msg.ReplyToID]; p != nil && p.from != from && !date.Before(p.at) {
+			delete(a.posts, msg.ReplyToID)
+			latency := date.Sub(p.at).Seconds()
+			senderMetrics.Metric(a.name(ReplyLatencySeconds)).Buckets(a.opts.ReplyLatencyBuckets...).Observe(latency, date)
+		}
+	}
+	if msg.ForwardedFrom != "" {
+		senderMetrics.Metric(a.name(ForwardsTotal)).With("source", msg.ForwardedFrom).Inc(1, date)
+	}
+	if msg.Poll != nil {
+		senderMetrics.Metric(a.name(PollsTotal)).Inc(1, date)
+		// Votes are not attributed to the sender of the poll.
+		question := a.metrics.Metric(a.name(PollVotesTotal)).With("question", sanitizeLabelValue(msg.Poll.Question))
+		for _, answer := range msg.Poll.Answers {
+			question.With("answer", sanitizeLabelValue(answer.Text)).Inc(answer.Voters, date)
+		}
+	}
+	for _, r := range msg.Reactions {
+		emoji := r.Emoji
+		if r.Type != "emoji" {
+			emoji = "custom"
+		}
+		senderMetrics.Metric(a.name(ReactionsTotal)).With("emoji", emoji).Inc(r.Count, date)
+	}
+	for _, e := range textEntities(msg) {
+		if e.Type != "plain" {
+			senderMetrics.Metric(a.name(FormattingEntitiesTotal)).With("type", e.Type).Inc(1, date)
+		}
+		switch e.Type {
+		case "mention", "mention_name":
+			senderMetrics.Metric(a.name(MentionsTotal)).With("mention", sanitizeLabelValue(e.Text)).Inc(1, date)
+		case "hashtag":
+			senderMetrics.Metric(a.name(HashtagsTotal)).With("hashtag", sanitizeLabelValue(e.Text)).Inc(1, date)
+		case "link", "text_link":
+			// Links are not labeled, as almost every link is unique.
+			senderMetrics.Metric(a.name(LinksTotal)).Inc(1, date)
+		}
+	}
+	texts := messageTexts(msg)
+	// Messages with media and a caption are counted as media and caption, not as text messages.
+	if len(texts) > 0 && msg.MediaType == "" {
+		senderMetrics.Metric(a.name(TextMessagesTotal)).Inc(1, date)
+	} else if len(texts) > 0 {
+		senderMetrics.Metric(a.name(CaptionsTotal)).Inc(1, date)
+	}
+	// Words may be split across entities, so they are counted in the whole text.
+	text := strings.Join(texts, "")
+	if msg.MediaType == "" && isEmojiOnly(text) {
+		senderMetrics.Metric(a.name(EmojiMessagesTotal)).Inc(1, date)
+	}
+	senderMetrics.Metric(a.name(WordsTotal)).Inc(uint64(len(strings.Fields(text))), date)
+	runes := utf8.RuneCountInString(text)
+	senderMetrics.Metric(a.name(RunesTotal)).Inc(uint64(runes), date)
+	if runes > 0 {
+		a.longest[msg.From] = addLongest(a.longest[msg.From], longest{date, runes})
+		senderMetrics.Metric(a.name(MessageLength)).Buckets(a.opts.MessageLengthBuckets...).Observe(float64(runes), date)
+		if len(a.opts.MessageLengthQuantiles) > 0 {
+			senderMetrics.Metric(a.name(MessageLengthSummary)).Quantiles(a.opts.MessageLengthQuantiles...).Observe(float64(runes), date)
+		}
+	}
+	senderMetrics.Metric(a.name(BytesTotal)).Inc(uint64(len(text)), date)
+	// Like words, expressions may span entities, e.g. a bold word in a sentence.
+	for _, expr := range a.opts.Expressions {
+		if n := len(expr.FindAllStringIndex(text, -1)); n > 0 {
+			senderMetrics.Metric(a.name(ExpressionsTotal)).With("expression", expr.label()).Inc(uint64(n), date)
+		}
+	}
+}
+
+// maxLabelValueLength is the maximum length of free text label values in runes.
+const maxLabelValueLength = 64
+
+// sanitizeLabelValue makes free text like poll questions usable as label value.
+// Whitespace including newlines is collapsed and long texts are truncated.
+func sanitizeLabelValue(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if utf8.RuneCountInString(s) <= maxLabelValueLength {
+		return s
+	}
+	runes := []rune(s)
+	return string(runes[:maxLabelValueLength-1]) + "…"
+}
+
+// messageTexts returns the texts of msg to analyze.
+func messageTexts(msg tgexport.Message) []string {
+	var texts []string
+	for _, e := range textEntities(msg) {
+		if e.Text != "" {
+			texts = append(texts, e.Text)
+		}
+	}
+	return texts
+}
+
+// textEntities returns the text entities of msg. Older exports, e.g. from the
+// mobile apps, lack text_entities and only have the text field, which is
+// either a plain string or an array of strings and entities.
+func textEntities(msg tgexport.Message) []tgexport.TextEntity {
+	if len(msg.TextEntities) > 0 {
+		return msg.TextEntities
+	}
+	return msg.Text
+}
@@ -0,0 +1,1082 @@
+package analyze
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/ngrash/tgstat/backfill"
+	"github.com/ngrash/tgstat/tgexport"
+)
+
+// analyze runs Analyze on the given result.json content and
+// returns the rendered metrics.
+func analyze(t *testing.T, export string, expressions ...*regexp.Regexp) string {
+	t.Helper()
+	var opts Options
+	for _, expr := range expressions {
+		opts.Expressions = append(opts.Expressions, Expression{Regexp: expr})
+	}
+	return analyzeWith(t, export, opts)
+}
+
+// analyzeWith is like analyze, but with the given options.
+func analyzeWith(t *testing.T, export string, opts Options) string {
+	t.Helper()
+	var data tgexport.Result
+	if err := json.Unmarshal([]byte(export), &data); err != nil {
+		t.Fatal(err)
+	}
+	metrics := backfill.NewMetrics()
+	if err := Analyze(context.Background(), &data, metrics, opts); err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := metrics.Write(&b, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+// assertLines fails the test if any of want is missing from the rendered metrics.
+func assertLines(t *testing.T, got string, want ...string) {
+	t.Helper()
+	lines := strings.Split(got, "\n")
+	for _, w := range want {
+		if !slices.Contains(lines, w) {
+			t.Errorf("missing line %q in:\n%s", w, got)
+		}
+	}
+}
+
+func TestAnalyzeChatPlainTextFallback(t *testing.T) {
+	got := analyze(t, `{"messages": [
+		{"from": "Alice", "date_unixtime": "1724500800", "text": ["lol ", {"type": "bold", "text": "yes"}], "text_entities": []}
+	]}`, regexp.MustCompile("lol"))
+	assertLines(t, got,
+		`tg_bytes_total{sender="Alice"} 7 1724500800`,
+		`tg_expressions_total{expression="lol",sender="Alice"} 1 1724500800`,
+	)
+}
+
+func TestAnalyzeChatExpressionAcrossEntities(t *testing.T) {
+	got := analyze(t, `{"messages": [
+		{"from": "Alice", "date_unixtime": "1724500800", "text": "", "text_entities": [
+			{"type": "bold", "text": "very"},
+			{"type": "plain", "text": " nice, very"},
+			{"type": "italic", "text": " nice"}
+		]}
+	]}`, regexp.MustCompile("very nice"))
+	assertLines(t, got,
+		`tg_expressions_total{expression="very nice",sender="Alice"} 2 1724500800`,
+		`tg_bytes_total{sender="Alice"} 20 1724500800`,
+	)
+}
+
+func TestAnalyzeChatSkipsServiceMessages(t *testing.T) {
+	// The service message has a sender to make sure it is skipped by type.
+	got := analyze(t, `{"messages": [
+		{"type": "message", "from": "Alice", "date_unixtime": "1724500800", "text": "Hi"},
+		{"type": "service", "from": "Alice", "actor": "Alice", "action": "pin_message", "date_unixtime": "1724500900", "text": ""}
+	]}`)
+	assertLines(t, got, `tg_messages_total{sender="Alice"} 1 1724500800`)
+	if strings.Contains(got, `tg_messages_total{sender="Alice"} 2`) {
+		t.Errorf("service message was counted:\n%s", got)
+	}
+}
+
+func TestAnalyzeChatWeekdayAndHour(t *testing.T) {
+	// Saturday 12:00, Saturday 13:00 and Sunday 12:00 UTC.
+	got := analyze(t, `{"messages": [
+		{"from": "Alice", "date_unixtime": "1724500800", "text": "Hi"},
+		{"from": "Alice", "date_unixtime": "1724504400", "text": "Hi"},
+		{"from": "Alice", "date_unixtime": "1724587200", "text": "Hi"}
+	]}`)
+	assertLines(t, got,
+		`tg_messages_by_weekday_total{sender="Alice",weekday="Sat"} 2 1724587200`,
+		`tg_messages_by_weekday_total{sender="Alice",weekday="Sun"} 1 1724587200`,
+		`tg_messages_by_hour_total{hour="12",sender="Alice"} 2 1724587200`,
+		`tg_messages_by_hour_total{hour="13",sender="Alice"} 1 1724587200`,
+	)
+}
+
+func TestAnalyzeChatMonth(t *testing.T) {
+	t.Cleanup(func() { tgexport.Location = time.UTC })
+	// 23:30 and 00:30 UTC at the end of July are 01:30 and 02:30 in August in Berlin.
+	const messages = `{"messages": [
+		{"from": "Alice", "date_unixtime": "1722468600", "text": "Hi"},
+		{"from": "Alice", "date_unixtime": "1722472200", "text": "Hi"}
+	]}`
+	assertLines(t, analyze(t, messages),
+		`tg_messages_by_month_total{month="2024-07",sender="Alice"} 1 1722472200`,
+		`tg_messages_by_month_total{month="2024-08",sender="Alice"} 1 1722472200`,
+	)
+
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tgexport.Location = berlin
+	got := analyze(t, messages)
+	assertLines(t, got, `tg_messages_by_month_total{month="2024-08",sender="Alice"} 2 1722472200`)
+	if strings.Contains(got, `month="2024-07"`) {
+		t.Errorf("got July in Berlin:\n%s", got)
+	}
+}
+
+func TestAnalyzeChatActiveSenders(t *testing.T) {
+	// Samples count the senders since the previous sample.
+	got := analyze(t, `{"messages": [
+		{"from": "Alice", "date_unixtime": "1724500800", "text": "Hi"},
+		{"from": "Bob", "date_unixtime": "1724500800", "text": "Hi"},
+		{"from": "Alice", "date_unixtime": "1724500800", "text": "Hi"},
+		{"from": "Carol", "date_unixtime": "1724501000", "text": "Hi"},
+		{"from": "Alice", "date_unixtime": "1724502000", "text": "Hi"},
+		{"from": "Bob", "date_unixtime": "1724504400", "text": "Hi"}
+	]}`)
+	assertLines(t, got,
+		`tg_active_senders 2 1724500800`,
+		`tg_active_senders 3 1724504400`,
+	)
+}
+
+func TestAnalyzeChatMessageLength(t *testing.T) {
+	got := analyzeWith(t, `{"messages": [
+		{"from": "Alice", "date_unixtime": "1724500800", "text": "Hi"},
+		{"from": "Alice", "date_unixtime": "1724500800", "text": "Hello, world"},
+		{"from": "Alice", "date_unixtime": "1724500800", "text": "Ünïcödé"},
+		{"from": "Alice", "date_unixtime": "1724500800", "text": "", "media_type": "sticker"}
+	]}`, Options{MessageLengthBuckets: []float64{5, 10}})
+	assertLines(t, got,
+		`tg_message_length_bucket{le="5",sender="Alice"} 1 1724500800`,
+		`tg_message_length_bucket{le="10",sender="Alice"} 2 1724500800`,
+		`tg_message_length_bucket{le="+Inf",sender="Alice"} 3 1724500800`,
+		`tg_message_length_count{sender="Alice"} 3 1724500800`,
+		`tg_message_length_sum{sender="Alice"} 21 1724500800`,
+	)
+}
+
+func TestAnalyzeChatMessageLengthSummary(t *testing.T) {
+	got := analyzeWith(t, `{"messages": [
+		{"from": "Alice", "date_unixtime": "1724500800", "text": "Hi"},
+		{"from": "Alice", "date_unixtime": "1724500800", "text": "Hello"},
+		{"from": "Alice", "date_unixtime": "1724500800", "text": "Hello, world"}
+	]}`, Options{MessageLengthQuantiles: []float64{0, 0.5, 1}})
+	assertLines(t, got,
+		`tg_message_length_summary{quantile="0",sender="Alice"} 2 1724500800`,
+		`tg_message_length_summary{quantile="0.5",sender="Alice"} 5 1724500800`,
+		`tg_message_length_summary{quantile="1",sender="Alice"} 12 1724500800`,
+		`tg_message_length_summary_count{sender="Alice"} 3 1724500800`,
+		`tg_message_length_summary_sum{sender="Alice"} 19 1724500800`,
+	)
+}
+
+func TestAnalyzeChatMedia(t *testing.T) {
+	got := analyze(t, `{"messages": [
+		{"from": "Alice", "date_unixtime": "1724500800", "text": "", "file": "stickers/sticker.webp", "media_type": "sticker"},
+		{"from": "Alice", "date_unixtime": "1724500800", "text": "", "photo": "photos/photo_1.jpg", "width": 1280, "height": 960},
+		{"from": "Alice", "date_unixtime": "1724500800", "text": "Hi"}
+	]}`)
+	assertLines(t, got,
+		`tg_media_total{media_type="sticker",sender="Alice"} 1 1724500800`,
+		`tg_media_total{media_type="photo",sender="Alice"} 1 1724500800`,
+	)
+}
+
+func TestAnalyzeChatReactions(t *testing.T) {
+	got := analyze(t, `{"messages": [
+		{"from": "Alice", "date_unixtime": "1724500800", "text": "Hi", "reactions": [
+			{"type": "emoji", "count": 3, "emoji": "👍", "recent": []},
+			{"type": "custom_emoji", "count": 2, "document_id": "stickers/custom.webp"}
+		]}
+	]}`)
+	assertLines(t, got,
+		`tg_reactions_total{emoji="👍",sender="Alice"} 3 1724500800`,
+		`tg_reactions_total{emoji="custom",sender="Alice"} 2 1724500800`,
+	)
+}
+
+func TestAnalyzeChatReplies(t *testing.T) {
+	got := analyze(t, `{"messages": [
+		{"id": 1, "from": "Alice", "date_unixtime": "1724500800", "text": "Hi"},
+		{"id": 2, "from": "Alice", "date_unixtime": "1724500800", "text": "Hi again", "reply_to_message_id": 1}
+	]}`)
+	assertLines(t, got,
+		`tg_messages_total{sender="Alice"} 2 1724500800`,
+		`tg_replies_total{sender="Alice"} 1 1724500800`,
+	)
+}
+
+func TestAnalyzeChatForwards(t *testing.T) {
+	got := analyze(t, `{"messages": [
+		{"id": 1, "from": "Alice", "date_unixtime": "1724500800", "text": "Hi"},
+		{"id": 2, "from": "Alice", "date_unixtime": "1724500800", "forwarded_from": "Some Channel", "text": "News"}
+	]}`)
+	assertLines(t, got,
+		`tg_messages_total{sender="Alice"} 2 1724500800`,
+		`tg_forwards_total{sender="Alice",source="Some Channel"} 1 1724500800`,
+	)
+}
+
+func TestAnalyzeChatWordsAndRunes(t *testing.T) {
+	got := analyze(t, `{"messages": [
+		{"from": "Alice", "date_unixtime": "1724500800", "text": "Hi 👋 你好", "text_entities": [
+			{"type": "plain", "text": "Hi 👋 "},
+			{"type": "bold", "text": "你好"}
+		]}
+	]}`)
+	assertLines(t, got,
+		`tg_words_total{sender="Alice"} 3 1724500800`,
+		`tg_runes_total{sender="Alice"} 7 1724500800`,
+		`tg_bytes_total{sender="Alice"} 14 1724500800`,
+	)
+}
+
+func TestAnalyzeChatCountsAllExpressionMatches(t *testing.T) {
+	got := analyze(t, `{"messages": [
+		{"from": "Alice", "date_unixtime": "1724500800", "text": "lol lol, LOL"}
+	]}`, regexp.MustCompile("(?i)lol"))
+	assertLines(t, got, `tg_expressions_total{expression="(?i)lol",sender="Alice"} 3 1724500800`)
+}
+
+func TestAnalyzeChatTimeWindow(t *testing.T) {
+	got := analyzeWith(t, `{"messages": [
+		{"from": "Alice", "date_unixtime": "1724497200", "text": "too early"},
+		{"from": "Alice", "date_unixtime": "1724500800", "text": "first"},
+		{"from": "Alice", "date_unixtime": "1724504399", "text": "last"},
+		{"from": "Alice", "date_unixtime": "1724504400", "text": "too late"}
+	]}`, Options{
+		Since: time.Unix(1724500800, 0),
+		Until: time.Unix(1724504400, 0),
+	})
+	want := "" +
+		`tg_messages_total{sender="Alice"} 1 1724500800` + "\n" +
+		`tg_messages_total{sender="Alice"} 2 1724504400` + "\n"
+	var lines []string
+	for _, l := range strings.SplitAfter(got, "\n") {
+		if strings.HasPrefix(l, MessagesTotal+"{") {
+			lines = append(lines, l)
+		}
+	}
+	if diff := cmp.Diff(want, strings.Join(lines, "")); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
+
+func TestAnalyzeChatEdits(t *testing.T) {
+	data, err := tgexport.ReadFile("../tgexport/testdata/edited.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := backfill.NewMetrics()
+	if err := Analyze(context.Background(), data, metrics, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := metrics.Write(&b, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, b.String(), `tg_edits_total{sender="Alice"} 1 1724500800`)
+}
+
+func TestAnalyzeChatMessagesPerBucket(t *testing.T) {
+	got := analyze(t, `{"messages": [
+		{"from": "Alice", "date_unixtime": "1724500800", "text": "Hi"},
+		{"from": "Alice", "date_unixtime": "1724502000", "text": "Hi"},
+		{"from": "Alice", "date_unixtime": "1724508000", "text": "Bye"}
+	]}`)
+	assertLines(t, got,
+		`tg_messages_per_bucket{sender="Alice"} 1 1724500800`,
+		`tg_messages_per_bucket{sender="Alice"} 1 1724504400`,
+		`tg_messages_per_bucket{sender="Alice"} 1 1724508000`,
+		`tg_messages_total{sender="Alice"} 3 1724508000`,
+	)
+}
+
+func TestAnalyzeChatSenderGap(t *testing.T) {
+	got := analyzeWith(t, `{"messages": [
+		{"from": "Alice", "date_unixtime": "1724500800", "text": "Hi"},
+		{"from": "Bob", "date_unixtime": "1724500830", "text": "Hi"},
+		{"from": "Alice", "date_unixtime": "1724500860", "text": "How are you?"},
+		{"from": "Alice", "date_unixtime": "1724501460", "text": "Hello?"}
+	]}`, Options{SenderGapBuckets: []float64{60, 300}})
+	assertLines(t, got,
+		`tg_sender_gap_seconds_bucket{le="60",sender="Alice"} 1 1724504400`,
+		`tg_sender_gap_seconds_bucket{le="300",sender="Alice"} 1 1724504400`,
+		`tg_sender_gap_seconds_bucket{le="+Inf",sender="Alice"} 2 1724504400`,
+		`tg_sender_gap_seconds_count{sender="Alice"} 2 1724504400`,
+		`tg_sender_gap_seconds_sum{sender="Alice"} 660 1724504400`,
+	)
+	if strings.Contains(got, `tg_sender_gap_seconds_count{sender="Bob"}`) {
+		t.Errorf("got gap for single message of Bob in:\n%s", got)
+	}
+}
+
+func TestAnalyzeChatReplyLatency(t *testing.T) {
+	data, err := tgexport.ReadFile("../tgexport/testdata/replies.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := backfill.NewMetrics()
+	if err := Analyze(context.Background(), data, metrics, Options{ReplyLatencyBuckets: []float64{60, 300}}); err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := metrics.Write(&b, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	got := b.String()
+	assertLines(t, got,
+		`tg_reply_latency_seconds_bucket{le="60",sender="Bob"} 0 1724504400`,
+		`tg_reply_latency_seconds_bucket{le="300",sender="Bob"} 1 1724504400`,
+		`tg_reply_latency_seconds_bucket{le="+Inf",sender="Bob"} 1 1724504400`,
+		`tg_reply_latency_seconds_count{sender="Bob"} 1 1724504400`,
+		`tg_reply_latency_seconds_sum{sender="Bob"} 90 1724504400`,
+	)
+	// Carol replies second, Alice to herself and Dave to a missing message.
+	for _, sender := range []string{"Alice", "Carol", "Dave"} {
+		if want := `tg_reply_latency_seconds_count{sender="` + sender + `"}`; strings.Contains(got, want) {
+			t.Errorf("got latency of %s in:\n%s", sender, got)
+		}
+	}
+}
+
+func TestAnalyzeChatExpressionName(t *testing.T) {
+	got := analyzeWith(t, `{"messages": [
+		{"from": "Alice", "date_unixtime": "1724500800", "text": "Hi there, hello!"}
+	]}`, Options{Expressions: []Expression{{Name: "greetings", Regexp: regexp.MustCompile(`(?i)\b(?:hi|hello)\b`)}}})
+	assertLines(t, got, `tg_expressions_total{expression="greetings",sender="Alice"} 2 1724500800`)
+}
+
+func TestAnalyzeChatSenderMaxMessageRunes(t *testing.T) {
+	got := analyze(t, `{"messages": [
+		{"from": "Alice", "date_unixtime": "1724500800", "text": "Hi"},
+		{"from": "Alice", "date_unixtime": "1724504400", "text": "How are you?"},
+		{"from": "Alice", "date_unixtime": "1724508000", "text": "Hello"}
+	]}`)
+	assertLines(t, got,
+		`tg_sender_max_message_runes{sender="Alice"} 2 1724500800`,
+		`tg_sender_max_message_runes{sender="Alice"} 12 1724504400`,
+		`tg_sender_max_message_runes{sender="Alice"} 12 1724508000`,
+	)
+}
+
+func TestAnalyzeChatSenderMaxMessageRunesOutOfOrder(t *testing.T) {
+	got := analyze(t, `{"messages": [
+		{"from": "Alice", "date_unixtime": "1724504400", "text": "How are you?"},
+		{"from": "Alice", "date_unixtime": "1724500800", "text": "twenty runes message"},
+		{"from": "Alice", "date_unixtime": "1724508000", "text": "Hi"}
+	]}`)
+	assertLines(t, got,
+		`tg_sender_max_message_runes{sender="Alice"} 20 1724500800`,
+		`tg_sender_max_message_runes{sender="Alice"} 20 1724504400`,
+		`tg_sender_max_message_runes{sender="Alice"} 20 1724508000`,
+	)
+}
+
+func TestAddLongest(t *testing.T) {
+	at := func(sec int64) time.Time { return time.Unix(1724500800+sec, 0) }
+	var s []longest
+	for _, l := range []longest{
+		{at(10), 5},
+		{at(30), 3}, // shorter than before
+		{at(40), 12},
+		{at(20), 8},  // out of order
+		{at(0), 10},  // out of order, makes the one at 10 and 20 obsolete
+		{at(40), 11}, // same time, but shorter
+	} {
+		s = addLongest(s, l)
+	}
+	want := []longest{{at(0), 10}, {at(40), 12}}
+	if diff := cmp.Diff(want, s, cmp.AllowUnexported(longest{})); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
+
+func TestAnalyzeChatFirstAndLastSeen(t *testing.T) {
+	got := analyze(t, `{"messages": [
+		{"from": "Alice", "date_unixtime": "1724500800", "text": "Hi"},
+		{"from": "Bob", "date_unixtime": "1724504400", "text": "Hi"},
+		{"from": "Alice", "date_unixtime": "1724508000", "text": "Bye"},
+		{"from": "Bob", "date_unixtime": "1724502000", "text": "Out of order"}
+	]}`)
+	assertLines(t, got,
+		`tg_sender_first_seen_timestamp{sender="Alice"} 1724500800 1724508000`,
+		`tg_sender_last_seen_timestamp{sender="Alice"} 1724508000 1724508000`,
+		`tg_sender_first_seen_timestamp{sender="Bob"} 1724502000 1724508000`,
+		`tg_sender_last_seen_timestamp{sender="Bob"} 1724504400 1724508000`,
+	)
+}
+
+func TestAnalyzeChatActiveDays(t *testing.T) {
+	got := analyze(t, `{"messages": [
+		{"from": "Alice", "date_unixtime": "1724500800", "text": "Hi"},
+		{"from": "Alice", "date_unixtime": "1724504400", "text": "Same day"},
+		{"from": "Alice", "date_unixtime": "1724587200", "text": "Next day"}
+	]}`)
+	assertLines(t, got,
+		`tg_sender_active_days_total{sender="Alice"} 1 1724504400`,
+		`tg_sender_active_days_total{sender="Alice"} 2 1724587200`,
+	)
+}
+
+func TestAnalyzeChatActiveDaysOutOfOrder(t *testing.T) {
+	got := analyze(t, `{"messages": [
+		{"from": "Alice", "date_unixtime": "1724587200", "text": "Next day"},
+		{"from": "Alice", "date_unixtime": "1724504400", "text": "Later that day"},
+		{"from": "Alice", "date_unixtime": "1724500800", "text": "Hi"}
+	]}`)
+	assertLines(t, got,
+		`tg_sender_active_days_total{sender="Alice"} 1 1724500800`,
+		`tg_sender_active_days_total{sender="Alice"} 1 1724504400`,
+		`tg_sender_active_days_total{sender="Alice"} 2 1724587200`,
+	)
+}
+
+func TestAnalyzeChatActiveDaysTimezone(t *testing.T) {
+	t.Cleanup(func() { tgexport.Location = time.UTC })
+	// 21:30 and 22:30 UTC are 23:30 and 00:30 of the next day in Berlin.
+	const messages = `{"messages": [
+		{"from": "Alice", "date_unixtime": "1724535000", "text": "Good night"},
+		{"from": "Alice", "date_unixtime": "1724538600", "text": "Can't sleep"}
+	]}`
+	assertLines(t, analyze(t, messages), `tg_sender_active_days_total{sender="Alice"} 1 1724538600`)
+
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tgexport.Location = berlin
+	assertLines(t, analyze(t, messages), `tg_sender_active_days_total{sender="Alice"} 2 1724538600`)
+}
+
+func TestAnalyzeChatPoll(t *testing.T) {
+	data, err := tgexport.ReadFile("../tgexport/testdata/poll.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := backfill.NewMetrics()
+	if err := Analyze(context.Background(), data, metrics, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := metrics.Write(&b, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, b.String(),
+		`tg_polls_total{sender="Bob",sender_type="user"} 1 1724500800`,
+		`tg_poll_votes_total{answer="Yes",question="Pizza tonight?"} 2 1724500800`,
+		`tg_poll_votes_total{answer="No",question="Pizza tonight?"} 1 1724500800`,
+	)
+}
+
+func TestAnalyzeChatEntities(t *testing.T) {
+	data, err := tgexport.ReadFile("../tgexport/testdata/entities.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := backfill.NewMetrics()
+	if err := Analyze(context.Background(), data, metrics, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := metrics.Write(&b, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, b.String(),
+		`tg_mentions_total{mention="@bob",sender="Alice",sender_type="user"} 1 1724500800`,
+		`tg_hashtags_total{hashtag="#pizza",sender="Alice",sender_type="user"} 1 1724500800`,
+		`tg_links_total{sender="Alice",sender_type="user"} 1 1724500800`,
+	)
+}
+
+func TestAnalyzeChatMetricsPrefix(t *testing.T) {
+	got := analyzeWith(t, `{"messages": [
+		{"from": "Alice", "date_unixtime": "1724500800", "text": "Hi"}
+	]}`, Options{MetricsPrefix: "alice_"})
+	assertLines(t, got,
+		`alice_messages_total{sender="Alice"} 1 1724500800`,
+		`alice_active_senders 1 1724500800`,
+	)
+	if strings.Contains(got, MetricsPrefix) {
+		t.Errorf("got default prefix in:\n%s", got)
+	}
+}
+
+func TestAnalyzeFileChatTypes(t *testing.T) {
+	metrics := backfill.NewMetrics()
+	opts := Options{ChatTypes: []string{"private_group"}}
+	if err := AnalyzeFile(context.Background(), "../tgexport/testdata/full_export.json", metrics, opts); err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := metrics.Write(&b, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	got := b.String()
+	if !strings.Contains(got, `chat_type="private_group"`) {
+		t.Errorf("missing private_group chat in:\n%s", got)
+	}
+	if strings.Contains(got, `chat_type="personal_chat"`) {
+		t.Errorf("got filtered personal_chat in:\n%s", got)
+	}
+}
+
+func TestAnalyzeFileChatMessages(t *testing.T) {
+	metrics := backfill.NewMetrics()
+	if err := AnalyzeFile(context.Background(), "../tgexport/testdata/full_export.json", metrics, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := metrics.Write(&b, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, b.String(),
+		`tg_chat_messages_total{chat="Alice",chat_type="personal_chat"} 1 1724500800`,
+		`tg_chat_messages_total{chat="Friends",chat_type="private_group"} 2 1724508000`,
+	)
+}
+
+func TestAnalyzeChatMessagesAnonymous(t *testing.T) {
+	got := analyze(t, `{"messages": [
+		{"id": 1, "date_unixtime": "1724500800", "text": "Announcement"},
+		{"id": 2, "date_unixtime": "1724500800", "text": "Another one"},
+		{"id": 3, "type": "service", "date_unixtime": "1724500800", "action": "pin_message"}
+	]}`)
+	assertLines(t, got, `tg_chat_messages_total 2 1724500800`)
+	if strings.Contains(got, "sender=") {
+		t.Errorf("got sender series for anonymous messages:\n%s", got)
+	}
+}
+
+func TestAnalyzeFileLimitMessages(t *testing.T) {
+	for _, tc := range []struct {
+		limit int
+		want  int
+	}{
+		{limit: 0, want: 3},
+		{limit: 2, want: 2},
+		{limit: 5, want: 3},
+	} {
+		opts := Options{LimitMessages: tc.limit, Stats: &Stats{}}
+		if err := AnalyzeFile(context.Background(), "../tgexport/testdata/full_export.json", backfill.NewMetrics(), opts); err != nil {
+			t.Fatal(err)
+		}
+		if got := opts.Stats.Summary().Messages; got != tc.want {
+			t.Errorf("limit %d: got %d messages, want %d", tc.limit, got, tc.want)
+		}
+	}
+}
+
+func TestAnalyzeChatTextOnly(t *testing.T) {
+	data, err := tgexport.ReadFile("../tgexport/testdata/text_only.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := backfill.NewMetrics()
+	opts := Options{Expressions: []Expression{{Regexp: regexp.MustCompile("lol")}}}
+	if err := Analyze(context.Background(), data, metrics, opts); err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := metrics.Write(&b, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, b.String(),
+		`tg_bytes_total{sender="Alice"} 29 1724504400`,
+		`tg_expressions_total{expression="lol",sender="Alice"} 3 1724504400`,
+		`tg_hashtags_total{hashtag="#fun",sender="Alice"} 1 1724504400`,
+	)
+}
+
+func TestAnalyzeChatMediaBytes(t *testing.T) {
+	data, err := tgexport.ReadFile("../tgexport/testdata/media.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := backfill.NewMetrics()
+	if err := Analyze(context.Background(), data, metrics, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := metrics.Write(&b, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, b.String(),
+		`tg_media_bytes_total{media_type="photo",sender="Alice"} 1000 1724500800`,
+		`tg_media_bytes_total{media_type="photo",sender="Alice"} 4000 1724504400`,
+		`tg_media_bytes_total{media_type="video_file",sender="Alice"} 2500 1724504400`,
+	)
+}
+
+func TestAnalyzeChatEmojiMessages(t *testing.T) {
+	data, err := tgexport.ReadFile("../tgexport/testdata/emoji.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := backfill.NewMetrics()
+	if err := Analyze(context.Background(), data, metrics, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := metrics.Write(&b, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	got := b.String()
+	assertLines(t, got, `tg_emoji_messages_total{sender="Alice"} 1 1724500800`)
+	if strings.Contains(got, `tg_emoji_messages_total{sender="Bob"}`) {
+		t.Errorf("got emoji message of Bob's mixed message:\n%s", got)
+	}
+}
+
+func TestAnalyzeFileAttributeSenderless(t *testing.T) {
+	for _, attribute := range []bool{false, true} {
+		metrics := backfill.NewMetrics()
+		opts := Options{AttributeSenderless: attribute}
+		if err := AnalyzeFile(context.Background(), "../tgexport/testdata/channel.json", metrics, opts); err != nil {
+			t.Fatal(err)
+		}
+		var b strings.Builder
+		if err := metrics.Write(&b, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		got := b.String()
+		const want = `tg_messages_total{chat="News",chat_type="public_channel",sender="News",sender_type="channel"} 2 1724504400`
+		if attribute {
+			assertLines(t, got, want)
+		} else if strings.Contains(got, "tg_messages_total") {
+			t.Errorf("got channel posts without AttributeSenderless:\n%s", got)
+		}
+	}
+}
+
+func TestAnalyzeChatAttributeSenderlessSavedMessages(t *testing.T) {
+	got := analyzeWith(t, `{"messages": [
+		{"id": 1, "date_unixtime": "1724500800", "text": "Note to self"}
+	]}`, Options{
+		ChatType:            "saved_messages",
+		Self:                &tgexport.PersonalInformation{UserID: 42, FirstName: "Alice"},
+		AttributeSenderless: true,
+	})
+	assertLines(t, got,
+		`tg_messages_total{chat_type="saved_messages",sender="Alice"} 1 1724500800`,
+		`tg_self_messages_total{chat_type="saved_messages"} 1 1724500800`,
+	)
+}
+
+func TestAnalyzeChatSenderType(t *testing.T) {
+	data, err := tgexport.ReadFile("../tgexport/testdata/bot.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := backfill.NewMetrics()
+	if err := Analyze(context.Background(), data, metrics, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := metrics.Write(&b, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, b.String(),
+		`tg_messages_total{sender="Alice",sender_type="user"} 1 1724504400`,
+		`tg_messages_total{sender="Weather Bot",sender_type="bot"} 1 1724504400`,
+		`tg_messages_total{sender="News",sender_type="channel"} 1 1724504400`,
+		`tg_sender_first_seen_timestamp{sender="Weather Bot",sender_type="bot"} 1724500801 1724504400`,
+	)
+}
+
+func TestAnalyzeChatSenderTypeMaxCardinality(t *testing.T) {
+	var messages []string
+	for i := range 20 {
+		messages = append(messages, fmt.Sprintf(`{"from": "Sender %d", "from_id": "user%d", "date_unixtime": "1724500800", "text": "Hi"}`, i, i))
+	}
+	var data tgexport.Result
+	if err := json.Unmarshal([]byte(`{"messages": [`+strings.Join(messages, ",")+`]}`), &data); err != nil {
+		t.Fatal(err)
+	}
+	metrics := backfill.NewMetrics()
+	metrics.LimitCardinality(3)
+	if err := Analyze(context.Background(), &data, metrics, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := metrics.Write(&b, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	// Three senders and the overflow series.
+	var got []string
+	for _, line := range strings.Split(b.String(), "\n") {
+		if strings.HasPrefix(line, MessagesTotal+"{") {
+			got = append(got, line)
+		}
+	}
+	want := []string{
+		`tg_messages_total{sender="Sender 0",sender_type="user"} 1 1724500800`,
+		`tg_messages_total{sender="Sender 1",sender_type="user"} 1 1724500800`,
+		`tg_messages_total{sender="Sender 2",sender_type="user"} 1 1724500800`,
+		`tg_messages_total{sender="__other__",sender_type="__other__"} 17 1724500800`,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
+
+func TestSenderType(t *testing.T) {
+	for id, want := range map[string]string{
+		"user123":    "user",
+		"bot42":      "bot",
+		"channel7":   "channel",
+		"chat5":      "group",
+		"":           "",
+		"user":       "",
+		"unknown123": "",
+	} {
+		if got := senderType(id); got != want {
+			t.Errorf("senderType(%q) = %q, want %q", id, got, want)
+		}
+	}
+}
+
+func TestAnalyzeChatVoiceAndVideoSeconds(t *testing.T) {
+	data, err := tgexport.ReadFile("../tgexport/testdata/voice.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := backfill.NewMetrics()
+	if err := Analyze(context.Background(), data, metrics, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := metrics.Write(&b, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, b.String(),
+		`tg_voice_seconds_total{sender="Alice"} 12 1724500800`,
+		`tg_voice_seconds_total{sender="Alice"} 42 1724504400`,
+		`tg_video_seconds_total{sender="Alice"} 8 1724504400`,
+	)
+}
+
+func TestAnalyzeChatExcludeSenders(t *testing.T) {
+	got := analyzeWith(t, `{"messages": [
+		{"from": "Alice", "date_unixtime": "1724500800", "text": "Hi"},
+		{"from": "Telegram", "date_unixtime": "1724500800", "text": "Login code"},
+		{"from": "Telegram Bot", "date_unixtime": "1724500800", "text": "Login code"}
+	]}`, Options{
+		Aliases:        Aliases{"Telegram Bot": "Telegram"},
+		ExcludeSenders: []tgexport.Sender{"Telegram"},
+	})
+	assertLines(t, got,
+		`tg_messages_total{sender="Alice"} 1 1724500800`,
+		`tg_active_senders 1 1724500800`,
+	)
+	if strings.Contains(got, "Telegram") {
+		t.Errorf("got excluded sender in:\n%s", got)
+	}
+}
+
+func TestAnalyzeChatTextAndMedia(t *testing.T) {
+	data, err := tgexport.ReadFile("../tgexport/testdata/text_and_media.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := backfill.NewMetrics()
+	if err := Analyze(context.Background(), data, metrics, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := metrics.Write(&b, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, b.String(),
+		`tg_text_messages_total{sender="Bob"} 1 1724504400`, // the caption does not count
+		`tg_media_total{media_type="sticker",sender="Bob"} 1 1724504400`,
+		`tg_media_total{media_type="photo",sender="Bob"} 1 1724504400`,
+	)
+}
+
+func TestAnalyzeChatCaptions(t *testing.T) {
+	data, err := tgexport.ReadFile("../tgexport/testdata/captions.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := backfill.NewMetrics()
+	if err := Analyze(context.Background(), data, metrics, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := metrics.Write(&b, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	assertLines(t, b.String(),
+		`tg_captions_total{sender="Alice"} 1 1724504400`, // the plain photo has no caption
+		`tg_media_total{media_type="photo",sender="Alice"} 2 1724504400`,
+		`tg_text_messages_total{sender="Alice"} 1 1724504400`,
+	)
+}
+
+func TestAnalyzeChatNormalizeSenders(t *testing.T) {
+	got := analyzeWith(t, `{"messages": [
+		{"id": 1, "date_unixtime": "1724500800", "from": "Bob ", "text": "Hi"},
+		{"id": 2, "date_unixtime": "1724500800", "from": "Bob", "text": "Hi"},
+		{"id": 3, "date_unixtime": "1724500800", "from": "Robert  Smith", "text": "Hi"}
+	]}`, Options{
+		Aliases:            Aliases{"Robert  Smith": "  Bob"},
+		NormalizeSenders:   true,
+		CollapseWhitespace: true,
+	})
+	// The alias is normalized as well.
+	assertLines(t, got,
+		`tg_messages_total{sender="Bob"} 3 1724500800`,
+	)
+	if strings.Contains(got, `sender="Bob "`) || strings.Contains(got, `sender="  Bob"`) {
+		t.Errorf("got unnormalized senders:\n%s", got)
+	}
+}
+
+func TestAnalyzeChatNormalizeSendersNFC(t *testing.T) {
+	// Composed and decomposed forms of the same name. Whitespace within
+	// senders is kept without CollapseWhitespace.
+	got := analyzeWith(t, `{"messages": [
+		{"id": 1, "date_unixtime": "1724500800", "from": "Ren\u00e9", "text": "Hi"},
+		{"id": 2, "date_unixtime": "1724500800", "from": "Rene\u0301 ", "text": "Hi"},
+		{"id": 3, "date_unixtime": "1724500800", "from": "Mary  Ann", "text": "Hi"}
+	]}`, Options{NormalizeSenders: true})
+	assertLines(t, got,
+		"tg_messages_total{sender=\"Ren\u00e9\"} 2 1724500800",
+		`tg_messages_total{sender="Mary  Ann"} 1 1724500800`,
+	)
+	if strings.Contains(got, "e\u0301") {
+		t.Errorf("got decomposed sender:\n%s", got)
+	}
+}
+
+func TestAnalyzeFileSelf(t *testing.T) {
+	metrics := backfill.NewMetrics()
+	opts := Options{Aliases: Aliases{"Ally": "Alice"}}
+	if err := AnalyzeFile(context.Background(), "../tgexport/testdata/full_export_self.json", metrics, opts); err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := metrics.Write(&b, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	// Both messages of Alice count, by ID and by name, but not the one of Bob.
+	assertLines(t, b.String(),
+		`tg_self_messages_total{chat="Friends",chat_type="private_group"} 2 1724504400`,
+	)
+}
+
+func TestAnalyzeChatTopics(t *testing.T) {
+	data, err := tgexport.ReadFile("../tgexport/testdata/forum.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := backfill.NewMetrics()
+	if err := Analyze(context.Background(), data, metrics, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := metrics.Write(&b, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	got := b.String()
+	assertLines(t, got,
+		`tg_messages_total{sender="Alice"} 1 1724511540`, // before the first topic
+		`tg_messages_total{sender="Alice",topic="Memes"} 1 1724511540`,
+		`tg_messages_total{sender="Bob",topic="Memes"} 1 1724511540`, // reply to a message in the topic
+		`tg_messages_total{sender="Bob",topic="Events"} 1 1724511540`,
+		`tg_messages_total{sender="Bob",topic="general"} 1 1724511540`,
+		`tg_replies_total{sender="Bob"} 1 1724511540`,
+	)
+	// Messages before the first topic have none, and messages that start
+	// a thread in a topic are no replies.
+	for _, unwanted := range []string{`tg_messages_total{sender="Alice",topic="general"}`, `tg_replies_total{sender="Alice"}`} {
+		if strings.Contains(got, unwanted) {
+			t.Errorf("unexpected %s in:\n%s", unwanted, got)
+		}
+	}
+}
+
+func TestAnalyzeChatFormattingEntities(t *testing.T) {
+	data, err := tgexport.ReadFile("../tgexport/testdata/formatting.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := backfill.NewMetrics()
+	if err := Analyze(context.Background(), data, metrics, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := metrics.Write(&b, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	got := b.String()
+	assertLines(t, got,
+		`tg_formatting_entities_total{sender="Alice",type="code"} 2 1724504400`,
+		`tg_formatting_entities_total{sender="Alice",type="bold"} 1 1724504400`,
+		`tg_formatting_entities_total{sender="Alice",type="italic"} 1 1724504400`,
+		`tg_formatting_entities_total{sender="Alice",type="pre"} 1 1724504400`,
+		`tg_formatting_entities_total{sender="Bob",type="link"} 1 1724504400`,
+	)
+	if strings.Contains(got, `type="plain"`) {
+		t.Errorf("plain text counted in:\n%s", got)
+	}
+}
+
+func TestAnalyzeChatIncludeAnonymous(t *testing.T) {
+	data, err := tgexport.ReadFile("../tgexport/testdata/anonymous.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, include := range []bool{false, true} {
+		metrics := backfill.NewMetrics()
+		if err := Analyze(context.Background(), data, metrics, Options{IncludeAnonymous: include}); err != nil {
+			t.Fatal(err)
+		}
+		var b strings.Builder
+		if err := metrics.Write(&b, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		got := b.String()
+		assertLines(t, got, `tg_messages_total{sender="Alice"} 1 1724500800`)
+		if got := strings.Contains(got, `tg_messages_total{sender="<anonymous>"} 1`); got != include {
+			t.Errorf("IncludeAnonymous=%t: got anonymous messages %t, want %t", include, got, include)
+		}
+	}
+}
+
+func TestSanitizeLabelValue(t *testing.T) {
+	for in, want := range map[string]string{
+		"Pizza tonight?":        "Pizza tonight?",
+		"  Pizza\n\ttonight? ":  "Pizza tonight?",
+		strings.Repeat("ä", 64): strings.Repeat("ä", 64),
+		strings.Repeat("ä", 65): strings.Repeat("ä", 63) + "…",
+	} {
+		if got := sanitizeLabelValue(in); got != want {
+			t.Errorf("sanitizeLabelValue(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestAnalyzeCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	data := &tgexport.Result{Messages: []tgexport.Message{{From: "Alice"}}}
+	metrics := backfill.NewMetrics()
+	if err := Analyze(ctx, data, metrics, Options{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Analyze: got %v, want %v", err, context.Canceled)
+	}
+	err := AnalyzeFile(ctx, "../tgexport/testdata/full_export.json", metrics, Options{})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("AnalyzeFile: got %v, want %v", err, context.Canceled)
+	}
+	if err := metrics.Write(io.Discard, time.Hour); !errors.Is(err, backfill.ErrNoRecords) {
+		t.Errorf("got %v, want no records", err)
+	}
+}
+
+func TestAnalyzeCanceledMidway(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The export is canceled after two of its messages were analyzed.
+	stats := &Stats{}
+	chat := &tgexport.Chat{Name: "Friends"}
+	err := analyzeStream(ctx, backfill.NewMetrics(), Options{Stats: stats}, func(fn func(*tgexport.Chat, tgexport.Message) error) error {
+		for i := range 10 {
+			if i == 2 {
+				cancel()
+			}
+			msg := tgexport.Message{From: "Alice", Date: tgexport.Time(time.Unix(1724500800+int64(i), 0))}
+			if err := fn(chat, msg); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+	if got, want := stats.Summary().Messages, 2; got != want {
+		t.Errorf("got %d analyzed messages, want %d before the cancellation", got, want)
+	}
+}
+
+func TestAnalyzeReader(t *testing.T) {
+	const path = "../tgexport/testdata/full_export.json"
+	want := backfill.NewMetrics()
+	if err := AnalyzeFile(context.Background(), path, want, Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	got := backfill.NewMetrics()
+	if err := AnalyzeReader(context.Background(), f, got, Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var wantBuf, gotBuf strings.Builder
+	if err := want.Write(&wantBuf, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := got.Write(&gotBuf, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(wantBuf.String(), gotBuf.String()); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
+
+func TestAnalyzeChatStream(t *testing.T) {
+	const path = "../tgexport/testdata/full_export.json"
+	opts := Options{Aliases: Aliases{"Carol": "Caro"}}
+
+	chats, err := tgexport.ReadFullExport(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := backfill.NewMetrics()
+	for _, chat := range chats {
+		data := &tgexport.Result{Messages: chat.Messages}
+		chatOpts := opts
+		chatOpts.ChatName = chat.Name
+		chatOpts.ChatType = chat.Type
+		if err := Analyze(context.Background(), data, want, chatOpts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := backfill.NewMetrics()
+	if err := AnalyzeFile(context.Background(), path, got, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	var wantBuf, gotBuf strings.Builder
+	if err := want.Write(&wantBuf, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := got.Write(&gotBuf, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(wantBuf.String(), gotBuf.String()); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+	if !strings.Contains(gotBuf.String(), `sender="Caro"`) {
+		t.Errorf("alias not applied:\n%s", gotBuf.String())
+	}
+}
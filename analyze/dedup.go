@@ -0,0 +1,70 @@
+package analyze
+
+import "sync"
+
+// Dedup remembers the analyzed messages, so that messages in more than one
+// export, e.g. of overlapping time ranges, are counted once. Messages are
+// identified by the name of their chat and their ID. Messages without ID are
+// always counted. It is safe for concurrent use, so that files analyzed in
+// parallel can share the same Dedup.
+type Dedup struct {
+	mu   sync.Mutex
+	seen map[dedupKey]bool
+
+	// parent is the shared Dedup of an export's Dedup, see Export, and
+	// added are the messages the export added to it.
+	parent *Dedup
+	added  []dedupKey
+}
+
+type dedupKey struct {
+	chat string
+	id   int64
+}
+
+// Export returns a Dedup for a single export that remembers messages in d,
+// so that they can be forgotten with Forget if the export fails.
+func (d *Dedup) Export() *Dedup {
+	return &Dedup{parent: d}
+}
+
+// Forget removes the messages remembered by an export's Dedup from the
+// shared Dedup, so that other exports count them.
+func (d *Dedup) Forget() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.parent.mu.Lock()
+	defer d.parent.mu.Unlock()
+	for _, key := range d.added {
+		delete(d.parent.seen, key)
+	}
+	d.added = nil
+}
+
+// seenBefore reports whether the message with id in chat was seen before and
+// remembers it otherwise.
+func (d *Dedup) seenBefore(chat string, id int64) bool {
+	if id == 0 {
+		return false
+	}
+	if d.parent != nil {
+		if d.parent.seenBefore(chat, id) {
+			return true
+		}
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.added = append(d.added, dedupKey{chat, id})
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.seen == nil {
+		d.seen = make(map[dedupKey]bool)
+	}
+	key := dedupKey{chat, id}
+	if d.seen[key] {
+		return true
+	}
+	d.seen[key] = true
+	return false
+}
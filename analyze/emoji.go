@@ -0,0 +1,52 @@
+package analyze
+
+import "unicode"
+
+// emojiComponents are the runes that modify or join emoji, but are no emoji
+// on their own.
+var emojiComponents = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{Lo: 0x200d, Hi: 0x200d, Stride: 1}, // zero width joiner of sequences like 👨‍👩‍👧
+		{Lo: 0x20e3, Hi: 0x20e3, Stride: 1}, // combining enclosing keycap, as in 1️⃣
+		{Lo: 0xfe0e, Hi: 0xfe0f, Stride: 1}, // text and emoji presentation selectors
+	},
+	R32: []unicode.Range32{
+		{Lo: 0x1f3fb, Hi: 0x1f3ff, Stride: 1}, // skin tone modifiers
+		{Lo: 0xe0020, Hi: 0xe007f, Stride: 1}, // tags of flags like 🏴󠁧󠁢󠁳󠁣󠁴󠁿
+	},
+}
+
+// isEmojiOnly reports whether s consists of emoji and whitespace only, with
+// at least one emoji. Emoji are approximated by the Unicode category So
+// (Symbol, other), which includes all pictographs and the regional indicators
+// of flags, but also some symbols like ©. Keycaps like 1️⃣ are emoji, although
+// they start with a digit.
+func isEmojiOnly(s string) bool {
+	runes := []rune(s)
+	var emoji bool
+	for i, r := range runes {
+		switch {
+		case unicode.IsSpace(r), unicode.Is(emojiComponents, r):
+		case unicode.Is(unicode.So, r), r == '‼', r == '⁉':
+			emoji = true
+		case isKeycap(runes[i:]):
+			emoji = true
+		default:
+			return false
+		}
+	}
+	return emoji
+}
+
+// isKeycap reports whether runes start with a keycap sequence like 1️⃣, i.e.
+// a digit, # or * followed by the enclosing keycap, with or without the emoji
+// presentation selector in between.
+func isKeycap(runes []rune) bool {
+	if len(runes) < 2 || !(runes[0] >= '0' && runes[0] <= '9' || runes[0] == '#' || runes[0] == '*') {
+		return false
+	}
+	if runes[1] == 0xfe0f && len(runes) > 2 {
+		return runes[2] == 0x20e3
+	}
+	return runes[1] == 0x20e3
+}
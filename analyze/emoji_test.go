@@ -0,0 +1,28 @@
+package analyze
+
+import "testing"
+
+func TestIsEmojiOnly(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want bool
+	}{
+		{"😂", true},
+		{"😂 😂\n🎉", true},
+		{"👍🏽", true},    // skin tone modifier
+		{"👨‍👩‍👧", true}, // zero width joiner sequence
+		{"❤️", true},    // emoji presentation selector
+		{"🇩🇪", true},    // flag of regional indicators
+		{"1️⃣ 🔥", true}, // keycap
+		{"", false},
+		{" ", false},
+		{"\u200d\ufe0f", false}, // components only
+		{"lol 😂", false},
+		{"1 🔥", false},
+		{"😂!", false},
+	} {
+		if got := isEmojiOnly(tc.in); got != tc.want {
+			t.Errorf("isEmojiOnly(%q) = %t, want %t", tc.in, got, tc.want)
+		}
+	}
+}
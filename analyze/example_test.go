@@ -0,0 +1,39 @@
+package analyze_test
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/ngrash/tgstat/analyze"
+	"github.com/ngrash/tgstat/backfill"
+	"github.com/ngrash/tgstat/tgexport"
+)
+
+func ExampleAnalyze() {
+	data, err := tgexport.ReadFile("../tgexport/testdata/single_chat.json")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	metrics := backfill.NewMetrics()
+	opts := analyze.Options{
+		Aliases: analyze.Aliases{"Alice": "Ally"},
+	}
+	if err := analyze.Analyze(context.Background(), data, metrics, opts); err != nil {
+		log.Fatal(err)
+	}
+
+	var b strings.Builder
+	if err := metrics.Write(&b, time.Hour); err != nil {
+		log.Fatal(err)
+	}
+	for _, line := range strings.Split(b.String(), "\n") {
+		if strings.HasPrefix(line, analyze.MessagesTotal) {
+			fmt.Println(line)
+		}
+	}
+	// Output: tg_messages_total{sender="Ally"} 1 1724500800
+}
@@ -0,0 +1,78 @@
+package analyze
+
+import (
+	"encoding/json"
+	"os"
+	"regexp"
+)
+
+// Expression is a regular expression to count in message texts.
+type Expression struct {
+	// Name is the value of the expression label. Expressions without name
+	// are labeled with the regular expression.
+	Name string
+
+	*regexp.Regexp
+}
+
+// label returns the value of the expression label.
+func (e Expression) label() string {
+	if e.Name != "" {
+		return e.Name
+	}
+	return e.String()
+}
+
+// expressionConfig is an entry of the expressions file.
+// It is either a plain pattern or an object with matching options.
+type expressionConfig struct {
+	Name       string `json:"name"`
+	Pattern    string `json:"pattern"`
+	IgnoreCase bool   `json:"ignore_case"`
+	WholeWord  bool   `json:"whole_word"`
+}
+
+func (c *expressionConfig) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &c.Pattern); err == nil {
+		return nil
+	}
+	type config expressionConfig // prevent recursion
+	return json.Unmarshal(b, (*config)(c))
+}
+
+// compile translates the options into the regular expression.
+func (c expressionConfig) compile() (*regexp.Regexp, error) {
+	expr := c.Pattern
+	if c.WholeWord {
+		expr = `\b(?:` + expr + `)\b`
+	}
+	if c.IgnoreCase {
+		expr = "(?i)" + expr
+	}
+	return regexp.Compile(expr)
+}
+
+// LoadExpressions reads a JSON array of expressions to count in message texts.
+// Entries are either regular expressions or objects with a pattern, matching
+// options and an optional name, e.g. {"name": "lol", "pattern": "lol", "ignore_case": true}.
+func LoadExpressions(path string) ([]Expression, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var exprs []expressionConfig
+	if err := json.Unmarshal(buf, &exprs); err != nil {
+		return nil, err
+	}
+
+	var compiled []Expression
+	for _, expr := range exprs {
+		r, err := expr.compile()
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, Expression{Name: expr.Name, Regexp: r})
+	}
+	return compiled, nil
+}
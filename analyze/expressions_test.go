@@ -0,0 +1,55 @@
+package analyze
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadExpressionsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "expressions.json")
+	err := os.WriteFile(path, []byte(`[
+		"(?i)lol",
+		{"pattern": "yolo"},
+		{"pattern": "yolo", "ignore_case": true},
+		{"pattern": "yolo", "whole_word": true},
+		{"pattern": "yolo|lol", "ignore_case": true, "whole_word": true},
+		{"name": "greetings", "pattern": "hi|hello", "ignore_case": true, "whole_word": true}
+	]`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exprs, err := LoadExpressions(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tc := range []struct {
+		label   string
+		match   []string
+		noMatch []string
+	}{
+		{`(?i)lol`, []string{"LOL", "lollipop"}, []string{"lo l"}},
+		{`yolo`, []string{"yolo", "yolos"}, []string{"YOLO"}},
+		{`(?i)yolo`, []string{"YOLO", "Yolos"}, []string{"yo lo"}},
+		{`\b(?:yolo)\b`, []string{"yolo!", "so yolo"}, []string{"yolos", "YOLO"}},
+		{`(?i)\b(?:yolo|lol)\b`, []string{"YOLO", "Lol."}, []string{"lollipop", "yolos"}},
+		{`greetings`, []string{"Hi!", "hello"}, []string{"high"}},
+	} {
+		expr := exprs[i]
+		if got := expr.label(); got != tc.label {
+			t.Errorf("expression %d: got label %q, want %q", i, got, tc.label)
+		}
+		for _, s := range tc.match {
+			if !expr.MatchString(s) {
+				t.Errorf("%q does not match %q", tc.label, s)
+			}
+		}
+		for _, s := range tc.noMatch {
+			if expr.MatchString(s) {
+				t.Errorf("%q matches %q", tc.label, s)
+			}
+		}
+	}
+}
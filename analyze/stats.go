@@ -0,0 +1,108 @@
+package analyze
+
+import (
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ngrash/tgstat/tgexport"
+)
+
+// Stats counts the analyzed messages. It is safe for concurrent use, so that
+// files analyzed in parallel can share the same Stats.
+type Stats struct {
+	mu      sync.Mutex
+	summary Summary
+	senders map[tgexport.Sender]bool
+	chats   map[string]bool
+}
+
+// Summary is a snapshot of Stats.
+type Summary struct {
+	// Messages is the number of analyzed messages.
+	Messages int
+
+	// Senders is the number of distinct senders, after aliases were applied.
+	Senders int
+
+	// First and Last are the times of the first and the last analyzed message.
+	First, Last time.Time
+}
+
+// Summary returns the counts of the messages analyzed so far.
+func (s *Stats) Summary() Summary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.summary
+}
+
+// Chats returns the sorted names of the chats analyzed so far.
+func (s *Stats) Chats() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Sorted(maps.Keys(s.chats))
+}
+
+// Merge adds the messages and chats counted by other, e.g. of another file.
+// Senders counted by both count once.
+func (s *Stats) Merge(other *Stats) {
+	other.mu.Lock()
+	summary := other.summary
+	senders := maps.Clone(other.senders)
+	chats := maps.Clone(other.chats)
+	other.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.senders == nil {
+		s.senders = make(map[tgexport.Sender]bool)
+	}
+	if s.chats == nil {
+		s.chats = make(map[string]bool)
+	}
+	s.summary.Messages += summary.Messages
+	for sender := range senders {
+		if !s.senders[sender] {
+			s.senders[sender] = true
+			s.summary.Senders++
+		}
+	}
+	maps.Copy(s.chats, chats)
+	if s.summary.First.IsZero() || !summary.First.IsZero() && summary.First.Before(s.summary.First) {
+		s.summary.First = summary.First
+	}
+	if summary.Last.After(s.summary.Last) {
+		s.summary.Last = summary.Last
+	}
+}
+
+// addChat records that a chat with the given name is analyzed.
+func (s *Stats) addChat(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.chats == nil {
+		s.chats = make(map[string]bool)
+	}
+	s.chats[name] = true
+}
+
+// add counts a message by sender sent at date.
+func (s *Stats) add(sender tgexport.Sender, date time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.senders == nil {
+		s.senders = make(map[tgexport.Sender]bool)
+	}
+	s.summary.Messages++
+	if !s.senders[sender] {
+		s.senders[sender] = true
+		s.summary.Senders++
+	}
+	if s.summary.First.IsZero() || date.Before(s.summary.First) {
+		s.summary.First = date
+	}
+	if date.After(s.summary.Last) {
+		s.summary.Last = date
+	}
+}
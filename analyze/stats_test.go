@@ -0,0 +1,76 @@
+package analyze
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/ngrash/tgstat/backfill"
+	"github.com/ngrash/tgstat/tgexport"
+)
+
+func TestStats(t *testing.T) {
+	stats := &Stats{}
+	analyzeWith(t, `{"messages": [
+		{"from": "Alice", "date_unixtime": "1724504400", "text": "Hi"},
+		{"from": "Al", "date_unixtime": "1724500800", "text": "Out of order"},
+		{"from": "Bob", "date_unixtime": "1724508000", "text": "Hi"},
+		{"type": "service", "actor": "Carol", "date_unixtime": "1724511600"}
+	]}`, Options{Aliases: Aliases{"Al": "Alice"}, Stats: stats})
+
+	want := Summary{
+		Messages: 3,
+		Senders:  2,
+		First:    time.Unix(1724500800, 0),
+		Last:     time.Unix(1724508000, 0),
+	}
+	if diff := cmp.Diff(want, stats.Summary()); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
+
+func TestStatsMerge(t *testing.T) {
+	a, b := &Stats{}, &Stats{}
+	a.add("Alice", time.Unix(1724504400, 0))
+	a.addChat("Friends")
+	b.add("Alice", time.Unix(1724500800, 0))
+	b.add("Bob", time.Unix(1724508000, 0))
+	b.addChat("News")
+
+	a.Merge(b)
+	want := Summary{
+		Messages: 3,
+		Senders:  2,
+		First:    time.Unix(1724500800, 0),
+		Last:     time.Unix(1724508000, 0),
+	}
+	if diff := cmp.Diff(want, a.Summary()); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"Friends", "News"}, a.Chats()); diff != "" {
+		t.Errorf("chats diff -want +got:\n%s", diff)
+	}
+}
+
+func TestStatsChats(t *testing.T) {
+	stats := &Stats{}
+	data := &tgexport.Result{Messages: []tgexport.Message{
+		{From: "Alice", Date: tgexport.Time(time.Unix(1724500800, 0)), Text: tgexport.Text{{Text: "Hi"}}},
+	}}
+	for _, opts := range []Options{
+		{ChatName: "Friends", ChatType: "private_group"},
+		{ChatName: "News", ChatType: "public_channel", ChatTypes: []string{"private_group"}},
+		{ChatName: "Muted", ExcludeSenders: []tgexport.Sender{"Alice"}},
+	} {
+		opts.Stats = stats
+		if err := Analyze(context.Background(), data, backfill.NewMetrics(), opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Chats without analyzed messages are left out.
+	if diff := cmp.Diff([]string{"Friends"}, stats.Chats()); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
@@ -4,8 +4,14 @@
 package backfill
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -15,19 +21,226 @@ var ErrNoRecords = fmt.Errorf("no records")
 
 // recorder defines the interface for recording metrics.
 type recorder interface {
-	Inc(name string, value uint64, at time.Time)
-	Write(w io.Writer, resolution time.Duration) error
+	Inc(s series, value float64, at time.Time)
+	Set(s series, value float64, at time.Time)
+
+	// Max records value at the given time. The series reports the largest
+	// value recorded up to each resolution step.
+	Max(s series, value float64, at time.Time)
+
+	// Min is like Max, but the series reports the smallest value.
+	Min(s series, value float64, at time.Time)
+
+	// IncPerStep is like Inc, but the series reports the increment within
+	// each resolution step instead of the running total.
+	IncPerStep(s series, value float64, at time.Time)
+
+	// Distinct records that member was seen at the given time. Instead of a
+	// value, the series reports the number of distinct members per resolution step.
+	Distinct(s series, member string, at time.Time)
+
+	// DistinctTotal is like Distinct, but the series reports the number of
+	// distinct members seen up to each resolution step.
+	DistinctTotal(s series, member string, at time.Time)
+
+	// Summarize records an observation of value at the given time. Instead
+	// of a value, the series reports the given quantiles of all observations
+	// up to each resolution step, labeled with quantile.
+	Summarize(s series, quantiles []float64, value float64, at time.Time)
+
+	// Len returns the number of recorded series.
+	Len() int
+
+	// Merge adds the series recorded by other.
+	Merge(other recorder) error
+
+	// LimitCardinality limits the number of series per metric name to max.
+	// See Metrics.LimitCardinality.
+	LimitCardinality(max int)
+
+	// Overflowed returns the sorted names of metrics that exceeded the
+	// limit set with LimitCardinality.
+	Overflowed() []string
+
+	// Write writes all recorded series to w, one line per series and
+	// resolution step.
+	Write(w io.Writer, resolution time.Duration, opts ...WriteOption) error
+
+	// Walk calls fn for every series and resolution step, in the same
+	// order as Write writes the lines.
+	Walk(resolution time.Duration, o writeOptions, fn func(s series, value float64, at time.Time) error) error
+}
+
+// WriteOption configures how Metrics are written.
+type WriteOption func(*writeOptions)
+
+// writeOptions holds the configuration set by WriteOption values.
+type writeOptions struct {
+	align         bool
+	skipUnchanged bool
+	untilNow      bool
+	maxSpan       time.Duration
+	resolutions   map[string]time.Duration
+}
+
+// resolutionOf returns the resolution of the metric with the given name,
+// which defaults to resolution unless set with Resolutions.
+func (o writeOptions) resolutionOf(name string, resolution time.Duration) time.Duration {
+	if res := o.resolutions[name]; res > 0 {
+		return res
+	}
+	// Series of histograms and summaries use the resolution of their metric.
+	for _, suffix := range []string{"_bucket", "_count", "_sum"} {
+		if res := o.resolutions[strings.TrimSuffix(name, suffix)]; res > 0 && strings.HasSuffix(name, suffix) {
+			return res
+		}
+	}
+	return resolution
+}
+
+func newWriteOptions(opts []WriteOption) writeOptions {
+	var o writeOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// AlignToResolution makes the first sample start at a multiple of the
+// resolution, e.g. on the full hour, instead of at the time of the first record.
+// Series of different runs then have samples at the same times.
+func AlignToResolution() WriteOption {
+	return func(o *writeOptions) {
+		o.align = true
+	}
+}
+
+// UntilNow continues all series up to the current time of the Clock of the
+// Metrics, instead of ending them after their last record. The last values of
+// series then remain visible in queries of the present, e.g. the last seen
+// time of a sender who has been quiet for a while.
+func UntilNow() WriteOption {
+	return func(o *writeOptions) {
+		o.untilNow = true
+	}
+}
+
+// MaxSpan limits the written samples to the given span before the last
+// record, or with UntilNow before the current time, e.g. to skip years of
+// empty steps after a single old message. Older records still count towards
+// the values of counters at the first sample, but are not written as samples
+// of their own. A span that is not positive is ignored.
+func MaxSpan(span time.Duration) WriteOption {
+	return func(o *writeOptions) {
+		o.maxSpan = span
+	}
+}
+
+// Resolutions sets the resolution of the metrics with the given names,
+// overriding the resolution passed to Write, e.g. daily samples of gauges
+// that change rarely next to hourly samples of counters. Histograms and
+// summaries are named without suffix like _bucket. Resolutions that are not
+// positive are ignored.
+func Resolutions(resolutions map[string]time.Duration) WriteOption {
+	return func(o *writeOptions) {
+		o.resolutions = resolutions
+	}
+}
+
+// SkipUnchanged omits samples with the same value as the previous sample of
+// their series, which shrinks the output of series that rarely change.
+// The first and the last sample of each series are always written, so that
+// the series keeps its start and end. Note that Prometheus considers series
+// stale after 5 minutes without samples, so this is mostly useful for
+// databases without staleness handling, like VictoriaMetrics.
+func SkipUnchanged() WriteOption {
+	return func(o *writeOptions) {
+		o.skipUnchanged = true
+	}
+}
+
+// skipUnchanged wraps fn to omit samples with the same value as the previous
+// sample of their series. The returned flush function passes the last omitted
+// sample of each series to fn.
+func skipUnchanged(fn func(s series, value float64, at time.Time) error) (func(s series, value float64, at time.Time) error, func() error) {
+	type sample struct {
+		s     series
+		value float64
+		at    time.Time
+	}
+	var (
+		last    = map[string]float64{} // value of the last written sample, by series name
+		pending = map[string]sample{}  // last omitted sample, by series name
+	)
+	skip := func(s series, value float64, at time.Time) error {
+		name := s.String()
+		if v, ok := last[name]; ok && v == value {
+			pending[name] = sample{s, value, at}
+			return nil
+		}
+		delete(pending, name)
+		last[name] = value
+		return fn(s, value, at)
+	}
+	flush := func() error {
+		for _, name := range slices.Sorted(maps.Keys(pending)) {
+			p := pending[name]
+			if err := fn(p.s, p.value, p.at); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return skip, flush
 }
 
 // Metrics is a collection of metrics that share the same labels.
 type Metrics struct {
 	labels labels
 	rec    recorder
+	meta   *metadata
+}
+
+// Clock tells the current time. Metrics are recorded at explicit times, but
+// some features depend on the present, e.g. UntilNow. Tests use a fake clock
+// to make them deterministic.
+type Clock interface {
+	Now() time.Time
+}
+
+// realClock is the Clock of the system time.
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// Option configures Metrics created with NewMetrics.
+type Option func(*linkedListRecorder)
+
+// WithClock sets the clock that tells the current time, instead of the system time.
+func WithClock(c Clock) Option {
+	return func(r *linkedListRecorder) {
+		r.clock = c
+	}
+}
+
+// SummaryResolution sets the resolution at which the observations of summary
+// series are digested, one hour by default. Memory is bounded per step rather
+// than per observation. Quantiles are known as of the end of the step of an
+// observation, so they are up to date when written at the same resolution with
+// AlignToResolution and lag behind by less than the resolution otherwise.
+func SummaryResolution(resolution time.Duration) Option {
+	return func(r *linkedListRecorder) {
+		r.summaryResolution = resolution
+	}
 }
 
 // NewMetrics creates a new Metrics instance.
-func NewMetrics() *Metrics {
-	return newMetricsWithRecorder(newLinkedListRecorder())
+func NewMetrics(opts ...Option) *Metrics {
+	rec := newLinkedListRecorder()
+	for _, opt := range opts {
+		opt(rec)
+	}
+	return newMetricsWithRecorder(rec)
 }
 
 // newMetricsWithRecorder creates a new Metrics instance with the given recorder.
@@ -36,6 +249,7 @@ func newMetricsWithRecorder(rec recorder) *Metrics {
 	return &Metrics{
 		labels: labels{},
 		rec:    rec,
+		meta:   newMetadata(),
 	}
 }
 
@@ -44,6 +258,7 @@ func (m *Metrics) With(key, value string) *Metrics {
 	return &Metrics{
 		labels: m.labels.with(key, value),
 		rec:    m.rec,
+		meta:   m.meta,
 	}
 }
 
@@ -54,34 +269,158 @@ func (m *Metrics) Metric(name string) *Metric {
 		name:   name,
 		labels: m.labels,
 		rec:    m.rec,
+		meta:   m.meta,
+	}
+}
+
+// Len returns the number of recorded series of all Metrics that share
+// the same origin, regardless of their labels.
+func (m *Metrics) Len() int {
+	return m.rec.Len()
+}
+
+// LimitCardinality limits the number of series of each metric name to max,
+// e.g. to protect a database from labels with user-provided values like
+// hashtags. Once a metric has max series, values of new series are recorded
+// to a single overflow series of the metric instead, whose labels all have
+// the value OverflowLabelValue, except le of histogram buckets. Labels le do
+// not count as distinct series either. A limit of
+// zero, the default, disables it. Like Len, it applies to all Metrics that
+// share the same origin. Series added with Merge are not limited.
+func (m *Metrics) LimitCardinality(max int) {
+	m.rec.LimitCardinality(max)
+}
+
+// Overflowed returns the sorted names of metrics that exceeded the limit
+// set with LimitCardinality.
+func (m *Metrics) Overflowed() []string {
+	return m.rec.Overflowed()
+}
+
+// Write writes the Metrics to the given io.Writer with the given resolution.
+// Each line is a sample in the Prometheus text format: name{labels} value timestamp.
+func (m *Metrics) Write(w io.Writer, resolution time.Duration, opts ...WriteOption) error {
+	return m.rec.Write(w, resolution, opts...)
+}
+
+// Size returns the number of samples and bytes that Write writes with the
+// same arguments, without keeping the output, e.g. to estimate the cost of
+// an import. The bytes are those of the uncompressed text format.
+func (m *Metrics) Size(resolution time.Duration, opts ...WriteOption) (samples int, bytes int64, err error) {
+	var c countingWriter
+	if err := m.Write(&c, resolution, opts...); err != nil {
+		return 0, 0, err
 	}
+	return c.lines, c.bytes, nil
+}
+
+// countingWriter counts the bytes and lines written to it.
+type countingWriter struct {
+	bytes int64
+	lines int
 }
 
-// Write the Metrics to the given io.Writer with the given resolution.
-func (m *Metrics) Write(w io.Writer, resolution time.Duration) error {
-	return m.rec.Write(w, resolution)
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.bytes += int64(len(p))
+	c.lines += bytes.Count(p, []byte{'\n'})
+	return len(p), nil
 }
 
 // Metric represents a single metric that can be recorded.
 type Metric struct {
-	name   string
-	labels labels
-	rec    recorder
+	name      string
+	labels    labels
+	rec       recorder
+	meta      *metadata
+	buckets   []float64 // upper bounds of histogram buckets, see Observe
+	quantiles []float64 // quantiles of a summary, see Quantiles
 }
 
 // Inc records an increment of the metric by the given value at the given time.
 func (m *Metric) Inc(value uint64, at time.Time) {
-	s := fmt.Sprintf("%s{%s}", m.name, m.labels.String())
-	m.rec.Inc(s, value, at)
+	m.rec.Inc(m.series(), float64(value), at)
+}
+
+// Add records a change of the metric by the given delta at the given time.
+// Unlike Inc, the delta may be negative, so the metric is a gauge that can go
+// up and down, e.g. the number of pinned messages. Values may become negative.
+func (m *Metric) Add(delta int64, at time.Time) {
+	m.rec.Inc(m.series(), float64(delta), at)
+}
+
+// IncPerStep is like Inc, but the metric reports the increment within each
+// resolution step instead of the running total, e.g. the number of messages
+// per hour. Use it to chart activity without rate functions in queries.
+// A metric must not mix IncPerStep with Inc and Set.
+func (m *Metric) IncPerStep(value uint64, at time.Time) {
+	m.rec.IncPerStep(m.series(), float64(value), at)
+}
+
+// Set records the absolute value of the metric at the given time.
+// Use it for gauges, i.e. values that can go up and down.
+func (m *Metric) Set(value uint64, at time.Time) {
+	m.rec.Set(m.series(), float64(value), at)
+}
+
+// Max records value at the given time. The metric reports the largest value
+// recorded up to each resolution step, e.g. the length of the longest message
+// so far. Unlike with Set, values may be recorded in any order.
+func (m *Metric) Max(value uint64, at time.Time) {
+	m.rec.Max(m.series(), float64(value), at)
+}
+
+// Min is like Max, but the metric reports the smallest value recorded up to
+// each resolution step, e.g. the time of the first message.
+func (m *Metric) Min(value uint64, at time.Time) {
+	m.rec.Min(m.series(), float64(value), at)
+}
+
+// Distinct records that member, e.g. a user name, was seen at the given time.
+// Instead of accumulating values, the metric reports the number of distinct
+// members seen in each resolution step. A metric must either use Distinct or
+// Inc and Set.
+func (m *Metric) Distinct(member string, at time.Time) {
+	m.rec.Distinct(m.series(), member, at)
+}
+
+// DistinctTotal is like Distinct, but the metric reports the number of
+// distinct members seen up to each resolution step, e.g. the number of days a
+// sender was active. Unlike a counter, a member seen again, even in another
+// Metrics merged with Merge, does not count twice.
+func (m *Metric) DistinctTotal(member string, at time.Time) {
+	m.rec.DistinctTotal(m.series(), member, at)
+}
+
+// series returns the time series the Metric records to.
+func (m *Metric) series() series {
+	return series{name: m.name, labels: m.labels}
 }
 
 // With returns a copy of the Metric with an additional label appended.
 func (m *Metric) With(key, value string) *Metric {
 	return &Metric{
-		name:   m.name,
-		labels: m.labels.with(key, value),
-		rec:    m.rec,
+		name:      m.name,
+		labels:    m.labels.with(key, value),
+		rec:       m.rec,
+		meta:      m.meta,
+		buckets:   m.buckets,
+		quantiles: m.quantiles,
+	}
+}
+
+// series identifies a time series by its metric name and labels.
+type series struct {
+	name   string
+	labels labels
+}
+
+// String returns the name of the time series, e.g. name{key="value"}.
+// Series without labels are just named by their metric name.
+func (s series) String() string {
+	if len(s.labels) == 0 {
+		return s.name
 	}
+	return fmt.Sprintf("%s{%s}", s.name, s.labels.String())
 }
 
 // labels is a slice of label instances.
@@ -96,16 +435,27 @@ func (l labels) with(key, value string) labels {
 }
 
 // String returns a string representation of the labels.
-// Can be used to construct a metric name. Label values are
-// quoted as Go string literals.
+// Can be used to construct a metric name. Labels are sorted by key, so that
+// the same labels added in a different order name the same time series.
+// Label values are quoted and escaped as in the Prometheus text format.
 func (l labels) String() string {
+	if len(l) == 0 {
+		return ""
+	}
+	sorted := slices.SortedStableFunc(slices.Values(l), func(a, b label) int {
+		return strings.Compare(a.key, b.key)
+	})
 	var s string
-	for _, label := range l {
-		s += fmt.Sprintf("%s=%#v,", label.key, label.value)
+	for _, label := range sorted {
+		s += fmt.Sprintf("%s=\"%s\",", label.key, labelValueEscaper.Replace(label.value))
 	}
 	return s[:len(s)-1]
 }
 
+// labelValueEscaper escapes label values as required by the Prometheus text format.
+// See https://prometheus.io/docs/instrumenting/exposition_formats/#text-format-details
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
 // label is a key-value pair that adds context to a Metric.
 type label struct {
 	key   string
@@ -115,58 +465,398 @@ type label struct {
 // record is a single data point in time.
 // It is used by linkedListRecorder to store the data points in a linked list.
 type record struct {
-	value uint64
+	value float64
 	at    time.Time
 	next  *record
 }
 
 // forward return the record that represents the value at the given time and
 // a boolean indicating if the record has followup records.
+// It walks the list iteratively, as long lists would overflow the stack otherwise.
 func (r *record) forward(to time.Time) (*record, bool) {
-	//fmt.Println("move", r.at.Unix(), "to", to.Unix())
 	if r.at.After(to) {
 		// not yet started
 		return nil, true // followup is r itself
 	}
-	if r.next == nil {
-		return r, false // no followup
+	for r.next != nil && !r.next.at.After(to) {
+		r = r.next
 	}
-	if r.next.at.After(to) {
-		return r, true // followup is next
+	return r, r.next != nil // followup is next, if any
+}
+
+// sighting records that a member of a distinct series was seen at a time.
+type sighting struct {
+	member string
+	at     time.Time
+}
+
+// stepDigest is the digest of the observations of a summary series in the
+// step that ends at at, see SummaryResolution.
+type stepDigest struct {
+	at          time.Time
+	first, last time.Time // of the observations
+	digest      *tdigest
+}
+
+// recordKind determines how records of a series are merged with Merge.
+type recordKind int
+
+const (
+	counterKind recordKind = iota // values are summed
+	gaugeKind                     // the latest value wins
+	maxKind                       // the largest value wins
+	minKind                       // the smallest value wins
+)
+
+// extreme returns the larger of a and b for maxKind, or else the smaller.
+func (k recordKind) extreme(a, b float64) float64 {
+	if k == maxKind {
+		return max(a, b)
 	}
-	return r.next.forward(to)
+	return min(a, b)
 }
 
+// summaryCompression is the compression of the tdigests of summary series.
+// It bounds the memory of each step of a series to a few hundred centroids,
+// no matter how many values were observed in it.
+const summaryCompression = 100
+
 // linkedListRecorder implements the recorder interface using a linked list.
+// Distinct series are not cumulative and are kept as slices of sightings instead,
+// as are series recorded with DistinctTotal, which count all sightings so far.
+// Summary series are kept as slices of digests per step, sorted by time, and
+// their quantiles.
+// Series recorded with IncPerStep are cumulative like others, but are written
+// as the difference to the previous step. Series recorded with Set, Max or Min have
+// a recordKind, which matters only for Merge. All maps are keyed by the name
+// of the series.
+// It is safe for concurrent use.
 type linkedListRecorder struct {
-	first   map[string]*record
-	current map[string]*record
+	mu        sync.Mutex
+	series    map[string]series
+	first     map[string]*record
+	current   map[string]*record
+	sightings map[string][]sighting
+	perStep   map[string]bool
+	kinds     map[string]recordKind
+	totals    map[string]bool
+
+	digests           map[string][]stepDigest
+	quantiles         map[string][]float64
+	summaryResolution time.Duration
+
+	// maxCardinality is the limit of series per metric name, if not zero.
+	// cardinality holds the labels of the series per metric name, as
+	// formatted by cardinalityKey, and overflowed the limited metrics.
+	maxCardinality int
+	cardinality    map[string]map[string]bool
+	overflowed     map[string]bool
+
+	// clock tells the current time, see UntilNow.
+	clock Clock
 }
 
 func newLinkedListRecorder() *linkedListRecorder {
 	return &linkedListRecorder{
-		first:   make(map[string]*record),
-		current: make(map[string]*record),
+		series:    make(map[string]series),
+		first:     make(map[string]*record),
+		current:   make(map[string]*record),
+		sightings: make(map[string][]sighting),
+		perStep:   make(map[string]bool),
+		kinds:     make(map[string]recordKind),
+		totals:    make(map[string]bool),
+
+		digests:           make(map[string][]stepDigest),
+		quantiles:         make(map[string][]float64),
+		summaryResolution: time.Hour,
+
+		cardinality: make(map[string]map[string]bool),
+		overflowed:  make(map[string]bool),
+
+		clock: realClock{},
 	}
 }
 
-func (r *linkedListRecorder) Inc(name string, value uint64, at time.Time) {
-	if current, ok := r.current[name]; ok {
-		if current.at.After(at) {
-			fmt.Printf("backfill: %s: ignoring record at %d, current is at %d\n", name, at.Unix(), current.at.Unix())
-			return
+func (r *linkedListRecorder) Inc(s series, value float64, at time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s = r.limit(s)
+	rec, prev := r.insert(s, at)
+	if prev != nil {
+		rec.value = prev.value
+	}
+	// Records are cumulative, so the increment applies to all following records as well.
+	for ; rec != nil; rec = rec.next {
+		rec.value += value
+	}
+}
+
+func (r *linkedListRecorder) IncPerStep(s series, value float64, at time.Time) {
+	r.mu.Lock()
+	s = r.limit(s)
+	r.perStep[s.String()] = true
+	r.mu.Unlock()
+
+	r.Inc(s, value, at)
+}
+
+func (r *linkedListRecorder) Set(s series, value float64, at time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s = r.limit(s)
+	rec, _ := r.insert(s, at)
+	rec.value = value
+	r.kinds[s.String()] = gaugeKind
+}
+
+func (r *linkedListRecorder) Max(s series, value float64, at time.Time) {
+	r.extreme(s, value, at, maxKind)
+}
+
+func (r *linkedListRecorder) Min(s series, value float64, at time.Time) {
+	r.extreme(s, value, at, minKind)
+}
+
+// extreme records value for Max or Min, depending on kind.
+func (r *linkedListRecorder) extreme(s series, value float64, at time.Time, kind recordKind) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s = r.limit(s)
+	rec, prev := r.insert(s, at)
+	if prev != nil {
+		rec.value = kind.extreme(prev.value, value)
+	} else {
+		rec.value = value
+	}
+	// The value is the extreme so far, so it applies to all following records as well.
+	for rec = rec.next; rec != nil; rec = rec.next {
+		rec.value = kind.extreme(rec.value, value)
+	}
+	r.kinds[s.String()] = kind
+}
+
+func (r *linkedListRecorder) Distinct(s series, member string, at time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s = r.limit(s)
+	name := s.String()
+	r.series[name] = s
+	r.sightings[name] = append(r.sightings[name], sighting{member, at})
+}
+
+func (r *linkedListRecorder) DistinctTotal(s series, member string, at time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s = r.limit(s)
+	name := s.String()
+	r.series[name] = s
+	r.totals[name] = true
+	r.sightings[name] = append(r.sightings[name], sighting{member, at})
+}
+
+func (r *linkedListRecorder) Summarize(s series, quantiles []float64, value float64, at time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s = r.limit(s)
+	name := s.String()
+	r.series[name] = s
+	r.quantiles[name] = quantiles
+
+	// Observations are digested in the step that ends at or after them.
+	end := at.Truncate(r.summaryResolution)
+	if end.Before(at) {
+		end = end.Add(r.summaryResolution)
+	}
+	sd := r.stepDigest(name, end)
+	if at.Before(sd.first) {
+		sd.first = at
+	}
+	if at.After(sd.last) {
+		sd.last = at
+	}
+	sd.digest.add(value)
+}
+
+// stepDigest returns the digest of the named summary series in the step that
+// ends at end, adding an empty one if there is none yet.
+func (r *linkedListRecorder) stepDigest(name string, end time.Time) *stepDigest {
+	digests := r.digests[name]
+	i, found := slices.BinarySearchFunc(digests, end, func(sd stepDigest, t time.Time) int {
+		return sd.at.Compare(t)
+	})
+	if !found {
+		digests = slices.Insert(digests, i, stepDigest{at: end, first: end, last: end.Add(-r.summaryResolution), digest: newTDigest(summaryCompression)})
+		r.digests[name] = digests
+	}
+	return &digests[i]
+}
+
+// insert adds an empty record at the given time to the list of s and returns
+// it along with its predecessor, which is nil if the record is the first.
+// The list is kept sorted by time. Records are usually recorded in order, so
+// appending is cheap, while inserting earlier records walks the list.
+func (r *linkedListRecorder) insert(s series, at time.Time) (rec, prev *record) {
+	rec = &record{at: at}
+
+	name := s.String()
+	first, ok := r.first[name]
+	if !ok { // first time
+		r.series[name] = s
+		r.first[name] = rec
+		r.current[name] = rec
+		return rec, nil
+	}
+
+	if current := r.current[name]; !current.at.After(at) {
+		current.next = rec
+		r.current[name] = rec
+		return rec, current
+	}
+
+	if first.at.After(at) {
+		rec.next = first
+		r.first[name] = rec
+		return rec, nil
+	}
+
+	// The list has records before and after at.
+	prev = first
+	for !prev.next.at.After(at) {
+		prev = prev.next
+	}
+	rec.next = prev.next
+	prev.next = rec
+	return rec, prev
+}
+
+func (r *linkedListRecorder) LimitCardinality(max int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.maxCardinality = max
+}
+
+func (r *linkedListRecorder) Overflowed() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Sorted(maps.Keys(r.overflowed))
+}
+
+// OverflowLabelValue is the label value of series that collect the values
+// of series beyond the limit set with Metrics.LimitCardinality.
+const OverflowLabelValue = "__other__"
+
+// limit returns s, or the overflow series of its metric if s is new and the
+// metric already has the maximum number of series. The overflow series does
+// not count towards the limit, so that it is always recorded. The caller must
+// hold r.mu.
+func (r *linkedListRecorder) limit(s series) series {
+	if r.maxCardinality <= 0 {
+		return s
+	}
+	key := cardinalityKey(s.labels)
+	known := r.cardinality[s.name]
+	if known == nil {
+		known = make(map[string]bool)
+		r.cardinality[s.name] = known
+	}
+	if known[key] {
+		return s
+	}
+	// Overflow series of merged Metrics do not count towards the limit either.
+	if isOverflow(s.labels) {
+		r.overflowed[s.name] = true
+		return s
+	}
+	if len(known) < r.maxCardinality {
+		known[key] = true
+		return s
+	}
+	// Replace all labels, so that there is a single overflow series no matter
+	// which of them has too many values.
+	overflow := slices.Clone(s.labels)
+	for i := range overflow {
+		if overflow[i].key != "le" {
+			overflow[i].value = OverflowLabelValue
 		}
-		next := &record{current.value + value, at, nil}
-		current.next = next
-		r.current[name] = next
-	} else { // first time
-		next := &record{value, at, nil}
-		r.first[name] = next
-		r.current[name] = next
 	}
+	r.overflowed[s.name] = true
+	known[cardinalityKey(overflow)] = true
+	return series{name: s.name, labels: overflow}
+}
+
+// isOverflow reports whether l are the labels of an overflow series, see limit.
+func isOverflow(l labels) bool {
+	overflow := false
+	for _, l := range l {
+		if l.key == "le" {
+			continue
+		}
+		if l.value != OverflowLabelValue {
+			return false
+		}
+		overflow = true
+	}
+	return overflow
+}
+
+// cardinalityKey formats labels except le, so that all buckets of a
+// histogram count as a single series.
+func cardinalityKey(l labels) string {
+	return slices.DeleteFunc(slices.Clone(l), func(l label) bool { return l.key == "le" }).String()
+}
+
+func (r *linkedListRecorder) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.series)
 }
 
-func (r *linkedListRecorder) Write(w io.Writer, resolution time.Duration) error {
+func (r *linkedListRecorder) Write(w io.Writer, resolution time.Duration, opts ...WriteOption) error {
+	return r.Walk(resolution, newWriteOptions(opts), func(s series, value float64, at time.Time) error {
+		_, err := fmt.Fprintf(w, "%s %s %d\n", s, formatValue(value), at.Unix())
+		return err
+	})
+}
+
+// formatValue formats a sample value without exponent and trailing zeros,
+// so that integer values are written as integers.
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// last returns the time of the latest record. The caller must hold r.mu.
+func (r *linkedListRecorder) last() time.Time {
+	var last time.Time
+	for _, rec := range r.first {
+		for ; rec != nil; rec = rec.next {
+			if rec.at.After(last) {
+				last = rec.at
+			}
+		}
+	}
+	for _, sightings := range r.sightings {
+		if at := sightings[len(sightings)-1].at; at.After(last) {
+			last = at
+		}
+	}
+	for _, digests := range r.digests {
+		if at := digests[len(digests)-1].last; at.After(last) {
+			last = at
+		}
+	}
+	return last
+}
+
+func (r *linkedListRecorder) Walk(resolution time.Duration, o writeOptions, fn func(s series, value float64, at time.Time) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	// First record determines the start time.
 	var start *time.Time
 	for _, f := range r.first {
@@ -174,50 +864,212 @@ func (r *linkedListRecorder) Write(w io.Writer, resolution time.Duration) error
 			start = &f.at
 		}
 	}
+	for _, sightings := range r.sightings {
+		// Sightings may be recorded out of order.
+		slices.SortStableFunc(sightings, func(a, b sighting) int {
+			return a.at.Compare(b.at)
+		})
+		if start == nil || sightings[0].at.Before(*start) {
+			start = &sightings[0].at
+		}
+	}
+	for _, digests := range r.digests {
+		if start == nil || digests[0].first.Before(*start) {
+			start = &digests[0].first
+		}
+	}
 	if start == nil {
 		return ErrNoRecords
 	}
 
+	// With MaxSpan, the start is moved up to the span before the end.
+	clamped := false
+	if o.maxSpan > 0 {
+		end := r.clock.Now()
+		if !o.untilNow {
+			end = r.last()
+		}
+		if end.Sub(*start) > o.maxSpan {
+			clamped = true
+			s := end.Add(-o.maxSpan)
+			start = &s
+		}
+	}
+
+	flush := func() error { return nil }
+	if o.skipUnchanged {
+		fn, flush = skipUnchanged(fn)
+	}
+
 	current := map[string]*record{}
 	for name, r := range r.first {
 		current[name] = r
 	}
+	// Sort names so that the output is deterministic.
+	names := slices.Sorted(maps.Keys(r.series))
+	// Index of the first sighting after the previous step, by series, and
+	// the members seen so far by DistinctTotal series.
+	nextSighting := map[string]int{}
+	seenTotal := map[string]map[string]bool{}
+	// Value of the previous step of IncPerStep series.
+	previous := map[string]float64{}
+	// Digest of the observations up to the previous step, by summary series,
+	// and the index of the first step digest after it.
+	digests := map[string]*tdigest{}
+	nextDigest := map[string]int{}
+
+	// step passes the value of the named series at now to fn and reports
+	// whether the series has records after now.
+	step := func(name string, now time.Time) (bool, error) {
+		if sightings, ok := r.sightings[name]; ok {
+			// Count the distinct members seen since the previous step.
+			if sightings[0].at.After(now) {
+				return true, nil // not yet started
+			}
+			seen := map[string]bool{}
+			if r.totals[name] {
+				if seenTotal[name] == nil {
+					seenTotal[name] = seen
+				}
+				seen = seenTotal[name]
+			}
+			i := nextSighting[name]
+			for ; i < len(sightings) && !sightings[i].at.After(now); i++ {
+				seen[sightings[i].member] = true
+			}
+			nextSighting[name] = i
+			return i < len(sightings), fn(r.series[name], float64(len(seen)), now)
+		}
+
+		if steps, ok := r.digests[name]; ok {
+			// Quantiles are known as of the end of the step of an observation.
+			if steps[0].at.After(now) {
+				return true, nil // not yet started
+			}
+			d, ok := digests[name]
+			if !ok {
+				d = newTDigest(summaryCompression)
+				digests[name] = d
+			}
+			i := nextDigest[name]
+			for ; i < len(steps) && !steps[i].at.After(now); i++ {
+				d.merge(steps[i].digest)
+			}
+			nextDigest[name] = i
+			s := r.series[name]
+			for _, q := range r.quantiles[name] {
+				qs := series{name: s.name, labels: s.labels.with("quantile", formatValue(q))}
+				if err := fn(qs, d.quantile(q), now); err != nil {
+					return false, err
+				}
+			}
+			return i < len(steps), nil
+		}
+
+		next, hasMore := current[name].forward(now)
+		if next == nil {
+			return true, nil // not yet started
+		}
+		if hasMore {
+			// Move to next record.
+			current[name] = next
+		}
+		value := next.value
+		if r.perStep[name] {
+			value, previous[name] = value-previous[name], value
+		}
+		return hasMore, fn(r.series[name], value, now)
+	}
+
+	// Series with the same resolution are walked through time together as
+	// a group. The groups take turns in time order, so that all lines are
+	// written in time order.
+	type group struct {
+		resolution time.Duration
+		now        time.Time
+	}
+	groups := map[time.Duration]*group{}
+	groupOf := map[string]*group{}
+	for _, name := range names {
+		res := o.resolutionOf(r.series[name].name, resolution)
+		g, ok := groups[res]
+		if !ok {
+			g = &group{resolution: res, now: *start}
+			if o.align {
+				g.now = start.Truncate(res)
+			}
+			groups[res] = g
+		}
+		groupOf[name] = g
+	}
+	if clamped {
+		// Values since the previous step start at the step before the first.
+		for _, name := range names {
+			g := groupOf[name]
+			before := g.now.Add(-g.resolution)
+			if sightings, ok := r.sightings[name]; ok && !r.totals[name] {
+				i, _ := slices.BinarySearchFunc(sightings, before, func(s sighting, t time.Time) int {
+					if s.at.After(t) {
+						return 1
+					}
+					return -1
+				})
+				nextSighting[name] = i
+			} else if r.perStep[name] {
+				if rec, _ := current[name].forward(before); rec != nil {
+					previous[name] = rec.value
+				}
+			}
+		}
+	}
 
-	// Walk through time in resolution steps.
-	for now := *start; ; now = now.Add(resolution) {
-		//fmt.Println("step", now.Unix())
+	// Groups end after their last record, or with UntilNow at the last step
+	// before the current time.
+	var until time.Time
+	if o.untilNow {
+		until = r.clock.Now()
+	}
 
-		// Advance all metrics to the record at the current time.
-		// If the metrics has no record that is active at the current time,
+	for len(groups) > 0 {
+		// Advance the groups with the earliest step.
+		var now time.Time
+		for _, g := range groups {
+			if now.IsZero() || g.now.Before(now) {
+				now = g.now
+			}
+		}
+		// If a metric has no record that is active at the current time,
 		// it is skipped.
 		// If a metric has a record at the current time and future records,
-		// it is considered active and written to the output.
+		// it is considered active and passed to fn.
 		// If a metric has a record at the current time but no followup record,
-		// it is considered inactive but still written with the last value.
-		// When no more metrics are active, the loop ends.
-		var hasActiveMetrics bool
-		for name, r := range current {
-			next, hasMore := r.forward(now)
-			if next == nil {
-				// not yet started
+		// it is considered inactive but still passed with the last value.
+		// When no more metrics of a group are active, the group ends.
+		active := map[*group]bool{}
+		for _, name := range names {
+			g := groupOf[name]
+			if groups[g.resolution] != g || !g.now.Equal(now) {
 				continue
 			}
-			if hasMore {
-				hasActiveMetrics = true
-				// Move to next record.
-				current[name] = next
-			}
-
-			// Write the record.
-			_, err := fmt.Fprintf(w, "%s %d %d\n", name, next.value, now.Unix())
+			hasMore, err := step(name, now)
 			if err != nil {
 				return err
 			}
+			if hasMore {
+				active[g] = true
+			}
 		}
-		// All metrics are inactive. We are done.
-		if !hasActiveMetrics {
-			break
+		for res, g := range groups {
+			if !g.now.Equal(now) {
+				continue
+			}
+			if !active[g] && g.now.Add(res).After(until) {
+				// All metrics of the group are inactive. It is done.
+				delete(groups, res)
+				continue
+			}
+			g.now = g.now.Add(res)
 		}
 	}
-	return nil
+	return flush()
 }
@@ -1,8 +1,10 @@
 package backfill
 
 import (
+	"fmt"
 	"io"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -13,11 +15,51 @@ type labelTestRecorder struct {
 	names []string
 }
 
-func (r *labelTestRecorder) Inc(name string, _ uint64, _ time.Time) {
-	r.names = append(r.names, name)
+func (r *labelTestRecorder) Inc(s series, _ float64, _ time.Time) {
+	r.names = append(r.names, s.String())
 }
 
-func (r *labelTestRecorder) Render(_ io.Writer, _ time.Duration) {}
+func (r *labelTestRecorder) IncPerStep(s series, _ float64, _ time.Time) {
+	r.names = append(r.names, s.String())
+}
+
+func (r *labelTestRecorder) Set(s series, _ float64, _ time.Time) {
+	r.names = append(r.names, s.String())
+}
+
+func (r *labelTestRecorder) Max(s series, _ float64, _ time.Time) {
+	r.names = append(r.names, s.String())
+}
+
+func (r *labelTestRecorder) Min(s series, _ float64, _ time.Time) {
+	r.names = append(r.names, s.String())
+}
+
+func (r *labelTestRecorder) Distinct(s series, _ string, _ time.Time) {
+	r.names = append(r.names, s.String())
+}
+
+func (r *labelTestRecorder) DistinctTotal(s series, _ string, _ time.Time) {
+	r.names = append(r.names, s.String())
+}
+
+func (r *labelTestRecorder) Summarize(s series, _ []float64, _ float64, _ time.Time) {
+	r.names = append(r.names, s.String())
+}
+
+func (r *labelTestRecorder) Len() int { return len(r.names) }
+
+func (r *labelTestRecorder) Merge(_ recorder) error { return nil }
+
+func (r *labelTestRecorder) LimitCardinality(_ int) {}
+
+func (r *labelTestRecorder) Overflowed() []string { return nil }
+
+func (r *labelTestRecorder) Write(_ io.Writer, _ time.Duration, _ ...WriteOption) error { return nil }
+
+func (r *labelTestRecorder) Walk(_ time.Duration, _ writeOptions, _ func(series, float64, time.Time) error) error {
+	return nil
+}
 
 func TestMetrics(t *testing.T) {
 	tr := &labelTestRecorder{}
@@ -41,23 +83,60 @@ func TestMetrics(t *testing.T) {
 	}
 }
 
+func TestMetricsLabelOrder(t *testing.T) {
+	tr := &labelTestRecorder{}
+	m := newMetricsWithRecorder(tr)
+
+	m.With("sender", "Alice").Metric("qux").With("expression", "lol").Inc(1, time.Time{})
+	m.With("expression", "lol").With("sender", "Alice").Metric("qux").Inc(1, time.Time{})
+
+	want := []string{
+		"qux{expression=\"lol\",sender=\"Alice\"}",
+		"qux{expression=\"lol\",sender=\"Alice\"}",
+	}
+	if diff := cmp.Diff(want, tr.names); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
+
+func TestMetricsLabelValueEscaping(t *testing.T) {
+	tr := &labelTestRecorder{}
+	m := newMetricsWithRecorder(tr)
+
+	m.With("sender", "he said \"hi\"\n").Metric("qux").Inc(1, time.Time{})
+	m.With("sender", `C:\Users`).Metric("qux").Inc(1, time.Time{})
+	m.With("sender", "👍\t").Metric("qux").Inc(1, time.Time{})
+
+	want := []string{
+		`qux{sender="he said \"hi\"\n"}`,
+		`qux{sender="C:\\Users"}`,
+		"qux{sender=\"👍\t\"}",
+	}
+	if diff := cmp.Diff(want, tr.names); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
+
 func TestLinkedListRecorder(t *testing.T) {
 	start := time.Unix(1724512000, 0)
 
+	foo := series{name: "foo"}
 	r := newLinkedListRecorder()
-	r.Inc("foo", 1, start.Add(00*time.Second)) // 1
-	r.Inc("foo", 1, start.Add(10*time.Second)) // 2
+	r.Inc(foo, 1, start.Add(00*time.Second)) // 1
+	r.Inc(foo, 1, start.Add(10*time.Second)) // 2
 
 	// Record in between resolution steps.
 	// It should increase the value but not be rendered.
-	r.Inc("foo", 1, start.Add(15*time.Second)) // 3
+	r.Inc(foo, 1, start.Add(15*time.Second)) // 3
 
-	r.Inc("foo", 1, start.Add(20*time.Second)) // 4
+	r.Inc(foo, 1, start.Add(20*time.Second)) // 4
 
-	r.Inc("foo", 1, start.Add(33*time.Second)) // 5
+	r.Inc(foo, 1, start.Add(33*time.Second)) // 5
 
 	var b strings.Builder
-	r.Render(&b, 10*time.Second)
+	if err := r.Write(&b, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
 
 	got := b.String()
 	want := "foo 1 1724512000\n"
@@ -69,3 +148,565 @@ func TestLinkedListRecorder(t *testing.T) {
 		t.Errorf("diff -want +got:\n%s", diff)
 	}
 }
+
+func TestMetricsLimitCardinality(t *testing.T) {
+	at := time.Unix(1724512000, 0)
+
+	m := NewMetrics()
+	m.LimitCardinality(2)
+	alice := m.With("sender", "Alice")
+	for _, hashtag := range []string{"a", "b", "c", "d", "a"} {
+		alice.Metric("hashtags").With("hashtag", hashtag).Inc(1, at)
+	}
+	alice.Metric("messages").Inc(1, at)
+	// Series of other senders go to the same overflow series.
+	m.With("sender", "Bob").Metric("hashtags").With("hashtag", "e").Inc(1, at)
+	for _, length := range []float64{1, 2, 3} {
+		m.With("sender", fmt.Sprint(length)).Metric("length").Buckets(10).Observe(length, at)
+	}
+
+	var b strings.Builder
+	if err := m.Write(&b, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Split(strings.TrimSpace(b.String()), "\n")
+	want := []string{
+		`hashtags{hashtag="__other__",sender="__other__"} 3 1724512000`,
+		`hashtags{hashtag="a",sender="Alice"} 2 1724512000`,
+		`hashtags{hashtag="b",sender="Alice"} 1 1724512000`,
+		`length_bucket{le="+Inf",sender="1"} 1 1724512000`,
+		`length_bucket{le="+Inf",sender="2"} 1 1724512000`,
+		`length_bucket{le="+Inf",sender="__other__"} 1 1724512000`,
+		`length_bucket{le="10",sender="1"} 1 1724512000`,
+		`length_bucket{le="10",sender="2"} 1 1724512000`,
+		`length_bucket{le="10",sender="__other__"} 1 1724512000`,
+		`length_count{sender="1"} 1 1724512000`,
+		`length_count{sender="2"} 1 1724512000`,
+		`length_count{sender="__other__"} 1 1724512000`,
+		`length_sum{sender="1"} 1 1724512000`,
+		`length_sum{sender="2"} 2 1724512000`,
+		`length_sum{sender="__other__"} 3 1724512000`,
+		`messages{sender="Alice"} 1 1724512000`,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"hashtags", "length_bucket", "length_count", "length_sum"}, m.Overflowed()); diff != "" {
+		t.Errorf("overflowed: diff -want +got:\n%s", diff)
+	}
+}
+
+func TestLinkedListRecorderResolutions(t *testing.T) {
+	start := time.Unix(1724500800, 0)
+
+	messages := series{name: "messages"}
+	members := series{name: "members"}
+	length := series{name: "length_count"}
+	r := newLinkedListRecorder()
+	r.Inc(messages, 1, start)
+	r.Set(members, 3, start)
+	r.Inc(length, 1, start)
+	r.Inc(messages, 1, start.Add(3*time.Hour))
+	r.Set(members, 4, start.Add(150*time.Minute))
+	r.Inc(length, 1, start.Add(3*time.Hour))
+
+	var b strings.Builder
+	err := r.Write(&b, time.Hour, Resolutions(map[string]time.Duration{
+		"members": 2 * time.Hour,
+		"length":  3 * time.Hour,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "length_count 1 1724500800\n"
+	want += "members 3 1724500800\n"
+	want += "messages 1 1724500800\n"
+	want += "messages 1 1724504400\n"
+	want += "members 3 1724508000\n"
+	want += "messages 1 1724508000\n"
+	want += "length_count 2 1724511600\n"
+	want += "messages 2 1724511600\n"
+	want += "members 4 1724515200\n"
+	if diff := cmp.Diff(want, b.String()); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
+
+// fakeClock is a Clock that is stuck at a given time.
+type fakeClock time.Time
+
+func (c fakeClock) Now() time.Time { return time.Time(c) }
+
+func TestMetricsUntilNow(t *testing.T) {
+	start := time.Unix(1724500800, 0)
+
+	m := NewMetrics(WithClock(fakeClock(start.Add(150 * time.Minute))))
+	m.Metric("last_seen").Set(1724500800, start)
+	m.Metric("messages").Inc(1, start)
+	m.Metric("messages").Inc(1, start.Add(time.Hour))
+
+	var b strings.Builder
+	if err := m.Write(&b, time.Hour, UntilNow()); err != nil {
+		t.Fatal(err)
+	}
+	want := "last_seen 1724500800 1724500800\n"
+	want += "messages 1 1724500800\n"
+	want += "last_seen 1724500800 1724504400\n"
+	want += "messages 2 1724504400\n"
+	want += "last_seen 1724500800 1724508000\n"
+	want += "messages 2 1724508000\n"
+	if diff := cmp.Diff(want, b.String()); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
+
+func TestMetricsMaxSpan(t *testing.T) {
+	start := time.Unix(1724500800, 0)
+	old := start.AddDate(-3, 0, 0)
+
+	m := NewMetrics()
+	m.Metric("messages").Inc(1, old)
+	m.Metric("messages").Inc(1, start)
+	m.Metric("messages").Inc(1, start.Add(2*time.Hour))
+	m.Metric("active").Distinct("Alice", old)
+	m.Metric("active").Distinct("Bob", start.Add(time.Hour))
+	m.Metric("per_step").IncPerStep(1, old)
+	m.Metric("per_step").IncPerStep(1, start.Add(time.Hour))
+
+	var b strings.Builder
+	if err := m.Write(&b, time.Hour, MaxSpan(2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	// The old records count towards messages, but have no samples of their own.
+	want := "active 0 1724500800\n"
+	want += "messages 2 1724500800\n"
+	want += "per_step 0 1724500800\n"
+	want += "active 1 1724504400\n"
+	want += "messages 2 1724504400\n"
+	want += "per_step 1 1724504400\n"
+	want += "active 0 1724508000\n"
+	want += "messages 3 1724508000\n"
+	want += "per_step 0 1724508000\n"
+	if diff := cmp.Diff(want, b.String()); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
+
+func TestMetricsSize(t *testing.T) {
+	start := time.Unix(1724500800, 0)
+	m := NewMetrics()
+	alice := m.With("sender", "Alice")
+	alice.Metric("messages").Inc(1, start)
+	alice.Metric("messages").Inc(1, start.Add(10*time.Hour))
+	alice.Metric("length").Buckets(10, 100).Observe(42, start.Add(3*time.Hour))
+	m.Metric("active").Distinct("Alice", start.Add(5*time.Hour))
+
+	for _, opts := range [][]WriteOption{nil, {SkipUnchanged()}} {
+		var b strings.Builder
+		if err := m.Write(&b, time.Hour, opts...); err != nil {
+			t.Fatal(err)
+		}
+		samples, bytes, err := m.Size(time.Hour, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := strings.Count(b.String(), "\n"); samples != want {
+			t.Errorf("got %d samples, want %d", samples, want)
+		}
+		if want := int64(b.Len()); bytes != want {
+			t.Errorf("got %d bytes, want %d", bytes, want)
+		}
+	}
+}
+
+func TestLinkedListRecorderSet(t *testing.T) {
+	start := time.Unix(1724512000, 0)
+
+	foo := series{name: "foo"}
+	r := newLinkedListRecorder()
+	r.Set(foo, 5, start.Add(00*time.Second))
+	r.Set(foo, 3, start.Add(10*time.Second))
+	r.Set(foo, 7, start.Add(15*time.Second)) // overwritten before rendered
+	r.Set(foo, 2, start.Add(20*time.Second))
+	r.Set(foo, 4, start.Add(33*time.Second))
+
+	var b strings.Builder
+	if err := r.Write(&b, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	got := b.String()
+	want := "foo 5 1724512000\n"
+	want += "foo 3 1724512010\n"
+	want += "foo 2 1724512020\n"
+	want += "foo 2 1724512030\n"
+	want += "foo 4 1724512040\n"
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
+
+func TestLinkedListRecorderDistinct(t *testing.T) {
+	start := time.Unix(1724512000, 0)
+
+	foo := series{name: "foo"}
+	bar := series{name: "bar"}
+	r := newLinkedListRecorder()
+	r.Distinct(foo, "alice", start.Add(00*time.Second))
+	r.Distinct(foo, "bob", start.Add(5*time.Second))
+	r.Distinct(foo, "alice", start.Add(8*time.Second))
+	r.Distinct(foo, "carol", start.Add(20*time.Second))
+	r.Distinct(foo, "carol", start.Add(15*time.Second)) // out of order
+	r.Distinct(foo, "bob", start.Add(40*time.Second))
+	r.Inc(bar, 1, start.Add(20*time.Second))
+
+	var b strings.Builder
+	if err := r.Write(&b, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	got := b.String()
+	want := "foo 1 1724512000\n"
+	want += "foo 2 1724512010\n" // alice and bob
+	want += "bar 1 1724512020\n"
+	want += "foo 1 1724512020\n" // carol twice
+	want += "bar 1 1724512030\n"
+	want += "foo 0 1724512030\n"
+	want += "bar 1 1724512040\n"
+	want += "foo 1 1724512040\n"
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
+
+func TestLinkedListRecorderMax(t *testing.T) {
+	start := time.Unix(1724512000, 0)
+
+	foo := series{name: "foo"}
+	r := newLinkedListRecorder()
+	r.Max(foo, 5, start)
+	r.Max(foo, 3, start.Add(20*time.Second))
+	r.Max(foo, 12, start.Add(30*time.Second))
+	r.Max(foo, 20, start.Add(10*time.Second)) // out of order
+
+	var b strings.Builder
+	if err := r.Write(&b, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	want := "foo 5 1724512000\n"
+	want += "foo 20 1724512010\n"
+	want += "foo 20 1724512020\n"
+	want += "foo 20 1724512030\n"
+	if diff := cmp.Diff(want, b.String()); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
+
+func TestLinkedListRecorderMin(t *testing.T) {
+	start := time.Unix(1724512000, 0)
+
+	foo := series{name: "foo"}
+	r := newLinkedListRecorder()
+	r.Min(foo, 20, start.Add(10*time.Second))
+	r.Min(foo, 30, start.Add(20*time.Second))
+	r.Min(foo, 15, start) // out of order
+
+	var b strings.Builder
+	if err := r.Write(&b, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	want := "foo 15 1724512000\n"
+	want += "foo 15 1724512010\n"
+	want += "foo 15 1724512020\n"
+	if diff := cmp.Diff(want, b.String()); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
+
+func TestLinkedListRecorderDistinctTotal(t *testing.T) {
+	start := time.Unix(1724512000, 0)
+
+	foo := series{name: "foo"}
+	r := newLinkedListRecorder()
+	r.DistinctTotal(foo, "alice", start.Add(5*time.Second))
+	r.DistinctTotal(foo, "bob", start.Add(20*time.Second))
+	r.DistinctTotal(foo, "alice", start.Add(25*time.Second))
+	r.DistinctTotal(foo, "carol", start.Add(15*time.Second)) // out of order
+
+	var b strings.Builder
+	if err := r.Write(&b, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	want := "foo 1 1724512005\n"
+	want += "foo 2 1724512015\n" // carol
+	want += "foo 3 1724512025\n" // bob, alice again
+	if diff := cmp.Diff(want, b.String()); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
+
+func TestMetricsWithoutLabels(t *testing.T) {
+	m := NewMetrics()
+	m.Metric("foo").Inc(1, time.Unix(1724512000, 0))
+
+	var b strings.Builder
+	if err := m.Write(&b, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	got := b.String()
+	want := "foo 1 1724512000\n"
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+	if m.Len() != 1 {
+		t.Errorf("got %d series, want 1", m.Len())
+	}
+}
+
+func TestLinkedListRecorderOutOfOrder(t *testing.T) {
+	start := time.Unix(1724512000, 0)
+
+	foo := series{name: "foo"}
+	r := newLinkedListRecorder()
+	r.Inc(foo, 1, start.Add(10*time.Second))
+	r.Inc(foo, 1, start.Add(30*time.Second))
+	r.Inc(foo, 1, start.Add(20*time.Second)) // in the middle
+	r.Inc(foo, 1, start.Add(00*time.Second)) // before the first
+	r.Inc(foo, 1, start.Add(20*time.Second)) // same time as existing
+
+	var b strings.Builder
+	if err := r.Write(&b, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	got := b.String()
+	want := "foo 1 1724512000\n"
+	want += "foo 2 1724512010\n"
+	want += "foo 4 1724512020\n"
+	want += "foo 5 1724512030\n"
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
+
+// longRecorder returns a recorder with a single series of n records at 1s spacing.
+func longRecorder(n int) (*linkedListRecorder, time.Time) {
+	start := time.Unix(1724512000, 0)
+	r := newLinkedListRecorder()
+	foo := series{name: "foo"}
+	for i := range n {
+		r.Inc(foo, 1, start.Add(time.Duration(i)*time.Second))
+	}
+	return r, start
+}
+
+func TestLinkedListRecorderLongList(t *testing.T) {
+	const n = 500_000
+	r, start := longRecorder(n)
+
+	last, hasMore := r.first["foo"].forward(start.Add(n * time.Second))
+	if last.value != n || hasMore {
+		t.Errorf("forward to end: got value %v and hasMore %t, want %d and false", last.value, hasMore, n)
+	}
+
+	var lines int
+	err := r.Walk(time.Hour, writeOptions{}, func(series, float64, time.Time) error {
+		lines++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One line per started hour, plus the final line after the last record.
+	if want := n/3600 + 2; lines != want {
+		t.Errorf("got %d lines, want %d", lines, want)
+	}
+}
+
+func BenchmarkLinkedListRecorderWrite(b *testing.B) {
+	r, _ := longRecorder(500_000)
+	b.ResetTimer()
+	for range b.N {
+		if err := r.Write(io.Discard, time.Hour); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestLinkedListRecorderConcurrentInc(t *testing.T) {
+	const goroutines, incs = 8, 1000
+	start := time.Unix(1724512000, 0)
+	foo := series{name: "foo"}
+
+	r := newLinkedListRecorder()
+	var wg sync.WaitGroup
+	for g := range goroutines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range incs {
+				r.Inc(foo, 1, start.Add(time.Duration(i*goroutines+g)*time.Second))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := r.current["foo"].value; got != goroutines*incs {
+		t.Errorf("got %v, want %d", got, goroutines*incs)
+	}
+}
+
+func TestLinkedListRecorderAlignToResolution(t *testing.T) {
+	start := time.Unix(1724504225, 0) // 13:57:05 UTC
+	foo := series{name: "foo"}
+
+	r := newLinkedListRecorder()
+	r.Inc(foo, 1, start)
+	r.Inc(foo, 1, start.Add(time.Hour))
+
+	var b strings.Builder
+	if err := r.Write(&b, time.Hour, AlignToResolution()); err != nil {
+		t.Fatal(err)
+	}
+
+	got := b.String()
+	want := "foo 1 1724504400\n" // 14:00:00
+	want += "foo 2 1724508000\n" // 15:00:00
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
+
+func TestLinkedListRecorderGapBetweenSeries(t *testing.T) {
+	start := time.Unix(1724512000, 0)
+
+	r := newLinkedListRecorder()
+	r.Inc(series{name: "foo"}, 1, start)
+	r.Inc(series{name: "bar"}, 1, start.Add(30*time.Second))
+
+	var b strings.Builder
+	if err := r.Write(&b, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	got := b.String()
+	want := "foo 1 1724512000\n"
+	want += "foo 1 1724512010\n"
+	want += "foo 1 1724512020\n"
+	want += "bar 1 1724512030\n"
+	want += "foo 1 1724512030\n"
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
+
+func TestLinkedListRecorderSkipUnchanged(t *testing.T) {
+	start := time.Unix(1724512000, 0)
+	foo := series{name: "foo"}
+	bar := series{name: "bar"}
+
+	r := newLinkedListRecorder()
+	r.Inc(foo, 1, start)
+	r.Inc(foo, 1, start.Add(30*time.Second))
+	r.Inc(bar, 1, start.Add(10*time.Second))
+	r.Inc(bar, 1, start.Add(60*time.Second))
+
+	var all, skipped strings.Builder
+	if err := r.Write(&all, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Write(&skipped, 10*time.Second, SkipUnchanged()); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := strings.Count(all.String(), "\n"), 13; got != want {
+		t.Errorf("got %d lines without skipping, want %d:\n%s", got, want, all.String())
+	}
+	got := skipped.String()
+	want := "foo 1 1724512000\n"
+	want += "bar 1 1724512010\n"
+	want += "foo 2 1724512030\n"
+	want += "bar 2 1724512060\n"
+	want += "foo 2 1724512060\n" // last sample
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
+
+func TestLinkedListRecorderIncPerStep(t *testing.T) {
+	start := time.Unix(1724512000, 0)
+	foo := series{name: "foo"}
+	total := series{name: "foo_total"}
+
+	r := newLinkedListRecorder()
+	for _, offset := range []time.Duration{0, 5, 12, 15, 18, 41} {
+		r.IncPerStep(foo, 1, start.Add(offset*time.Second))
+		r.Inc(total, 1, start.Add(offset*time.Second))
+	}
+
+	var b strings.Builder
+	if err := r.Write(&b, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	got := b.String()
+	want := "foo 1 1724512000\n"
+	want += "foo_total 1 1724512000\n"
+	want += "foo 1 1724512010\n"
+	want += "foo_total 2 1724512010\n"
+	want += "foo 3 1724512020\n"
+	want += "foo_total 5 1724512020\n"
+	want += "foo 0 1724512030\n"
+	want += "foo_total 5 1724512030\n"
+	want += "foo 0 1724512040\n"
+	want += "foo_total 5 1724512040\n"
+	want += "foo 1 1724512050\n"
+	want += "foo_total 6 1724512050\n"
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+
+	// The increments per step add up to the running total.
+	var sum, last float64
+	err := r.Walk(10*time.Second, writeOptions{}, func(s series, value float64, _ time.Time) error {
+		if s.name == "foo" {
+			sum += value
+		} else {
+			last = value
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != last {
+		t.Errorf("got sum of increments %v, want total %v", sum, last)
+	}
+}
+
+func TestMetricAdd(t *testing.T) {
+	start := time.Unix(1724512000, 0)
+
+	m := NewMetrics()
+	pinned := m.Metric("pinned")
+	pinned.Add(2, start)
+	pinned.Add(-1, start.Add(10*time.Second))
+	pinned.Add(3, start.Add(20*time.Second))
+	pinned.Add(-5, start.Add(30*time.Second))
+	pinned.Add(-1, start.Add(15*time.Second)) // out of order
+
+	var b strings.Builder
+	if err := m.Write(&b, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	got := b.String()
+	want := "pinned 2 1724512000\n"
+	want += "pinned 1 1724512010\n"
+	want += "pinned 3 1724512020\n"
+	want += "pinned -2 1724512030\n"
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
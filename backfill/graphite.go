@@ -0,0 +1,69 @@
+package backfill
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+)
+
+// graphiteNodeEscaper replaces characters that would split or break
+// a node of a Graphite metric path.
+var graphiteNodeEscaper = strings.NewReplacer(".", "_", " ", "_", "\t", "_", "\n", "_")
+
+// WriteGraphite writes the Metrics to the given io.Writer with the given
+// resolution in the Graphite plaintext protocol. Each sample is written as
+//
+//	prefix.name.key.value value timestamp
+//
+// with labels sorted by key and folded into the metric path. The prefix of
+// metric names, e.g. tg_, becomes the first node of the path without its
+// trailing underscore, so that tg_messages_total is written as
+// tg.messages_total. Dots and spaces in label values are replaced with
+// underscores.
+//
+// See https://graphite.readthedocs.io/en/latest/feeding-carbon.html#the-plaintext-protocol
+func (m *Metrics) WriteGraphite(w io.Writer, prefix string, resolution time.Duration, opts ...WriteOption) error {
+	// Paths are the same for all samples of a series, so they are rendered once.
+	paths := map[string]string{}
+	return m.rec.Walk(resolution, newWriteOptions(opts), func(s series, value float64, at time.Time) error {
+		name := s.String()
+		p, ok := paths[name]
+		if !ok {
+			p = graphitePath(s, prefix)
+			paths[name] = p
+		}
+		_, err := fmt.Fprintf(w, "%s %s %d\n", p, formatValue(value), at.Unix())
+		return err
+	})
+}
+
+// graphitePath renders the metric name and labels of s as dotted path, with
+// the prefix of the name as separate node. Labels with empty values are
+// skipped, as paths must not have empty nodes.
+func graphitePath(s series, prefix string) string {
+	sorted := slices.Clone(s.labels)
+	slices.SortStableFunc(sorted, func(a, b label) int {
+		return cmp.Compare(a.key, b.key)
+	})
+	var p strings.Builder
+	name := s.name
+	if node := strings.TrimRight(prefix, "_"); node != "" && strings.HasPrefix(name, prefix) && len(name) > len(prefix) {
+		p.WriteString(graphiteNodeEscaper.Replace(node))
+		p.WriteByte('.')
+		name = strings.TrimPrefix(name, prefix)
+	}
+	p.WriteString(graphiteNodeEscaper.Replace(name))
+	for _, label := range sorted {
+		if label.value == "" {
+			continue
+		}
+		p.WriteByte('.')
+		p.WriteString(graphiteNodeEscaper.Replace(label.key))
+		p.WriteByte('.')
+		p.WriteString(graphiteNodeEscaper.Replace(label.value))
+	}
+	return p.String()
+}
@@ -0,0 +1,48 @@
+package backfill
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWriteGraphite(t *testing.T) {
+	start := time.Unix(1724512000, 0)
+
+	m := NewMetrics()
+	bob := m.With("sender", "bob")
+	bob.Metric("tg_messages_total").With("chat", "").Inc(1, start)
+	bob.Metric("tg_messages_total").With("chat", "").Inc(1, start.Add(time.Hour))
+	m.With("sender", "Dr. Who").With("chat", "friends").Metric("tg_messages_total").Inc(1, start)
+
+	var b strings.Builder
+	if err := m.WriteGraphite(&b, "tg_", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	got := b.String()
+	want := "tg.messages_total.sender.bob 1 1724512000\n" // empty chat is skipped
+	want += "tg.messages_total.chat.friends.sender.Dr__Who 1 1724512000\n"
+	want += "tg.messages_total.sender.bob 2 1724515600\n"
+	want += "tg.messages_total.chat.friends.sender.Dr__Who 1 1724515600\n"
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
+
+func TestGraphitePathPrefix(t *testing.T) {
+	for _, tc := range []struct {
+		name, prefix, want string
+	}{
+		{name: "tg_messages_total", prefix: "tg_", want: "tg.messages_total"},
+		{name: "work_tg_messages_total", prefix: "work_tg_", want: "work_tg.messages_total"},
+		{name: "tg_messages_total", prefix: "", want: "tg_messages_total"},
+		{name: "up", prefix: "tg_", want: "up"}, // without the prefix
+	} {
+		if got := graphitePath(series{name: tc.name}, tc.prefix); got != tc.want {
+			t.Errorf("graphitePath(%q, %q): got %q, want %q", tc.name, tc.prefix, got, tc.want)
+		}
+	}
+}
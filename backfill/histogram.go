@@ -0,0 +1,59 @@
+package backfill
+
+import (
+	"math"
+	"slices"
+	"time"
+)
+
+// Buckets returns a copy of the Metric that records observations into
+// histogram buckets with the given upper bounds. See Observe.
+func (m *Metric) Buckets(upperBounds ...float64) *Metric {
+	buckets := slices.Clone(upperBounds)
+	slices.Sort(buckets)
+	return &Metric{
+		name:    m.name,
+		labels:  m.labels,
+		rec:     m.rec,
+		meta:    m.meta,
+		buckets: buckets,
+	}
+}
+
+// Observe records a single observation of value at the given time in a
+// Prometheus histogram. The counters name_bucket{le="bound"} count the
+// observations less than or equal to the upper bounds set with Buckets,
+// including le="+Inf" for all observations. name_count counts the
+// observations as well and name_sum sums up their values.
+//
+// If quantiles were set with Quantiles, the observation is recorded in a
+// Prometheus summary instead. The series name{quantile="q"} estimate the
+// quantiles of all observations up to each step, and name_count and name_sum
+// are the same as for histograms.
+//
+// See https://prometheus.io/docs/concepts/metric_types/#histogram
+// and https://prometheus.io/docs/concepts/metric_types/#summary
+func (m *Metric) Observe(value float64, at time.Time) {
+	if len(m.quantiles) > 0 {
+		m.rec.Summarize(m.series(), m.quantiles, value, at)
+		m.rec.Inc(series{name: m.name + "_count", labels: m.labels}, 1, at)
+		m.rec.Inc(series{name: m.name + "_sum", labels: m.labels}, value, at)
+		return
+	}
+	for _, bound := range m.buckets {
+		var inc float64
+		if value <= bound {
+			inc = 1
+		}
+		// Buckets are incremented by zero as well, so that all buckets exist.
+		m.rec.Inc(m.bucket(bound), inc, at)
+	}
+	m.rec.Inc(m.bucket(math.Inf(1)), 1, at)
+	m.rec.Inc(series{name: m.name + "_count", labels: m.labels}, 1, at)
+	m.rec.Inc(series{name: m.name + "_sum", labels: m.labels}, value, at)
+}
+
+// bucket returns the series of the histogram bucket with the given upper bound.
+func (m *Metric) bucket(bound float64) series {
+	return series{name: m.name + "_bucket", labels: m.labels.with("le", formatValue(bound))}
+}
@@ -0,0 +1,40 @@
+package backfill
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMetricObserve(t *testing.T) {
+	start := time.Unix(1724512000, 0)
+
+	m := NewMetrics().Metric("len").Buckets(100, 10)
+	m.Observe(5, start)
+	m.Observe(10, start)
+	m.Observe(50, start)
+	m.Observe(500, start)
+	m.Observe(0.5, start.Add(10*time.Second))
+
+	var b strings.Builder
+	if err := m.rec.Write(&b, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	got := b.String()
+	want := "len_bucket{le=\"+Inf\"} 4 1724512000\n"
+	want += "len_bucket{le=\"10\"} 2 1724512000\n"
+	want += "len_bucket{le=\"100\"} 3 1724512000\n"
+	want += "len_count 4 1724512000\n"
+	want += "len_sum 565 1724512000\n"
+	want += "len_bucket{le=\"+Inf\"} 5 1724512010\n"
+	want += "len_bucket{le=\"10\"} 3 1724512010\n"
+	want += "len_bucket{le=\"100\"} 4 1724512010\n"
+	want += "len_count 5 1724512010\n"
+	want += "len_sum 565.5 1724512010\n"
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
@@ -0,0 +1,59 @@
+package backfill
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxKeyEscaper         = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+)
+
+// WriteInflux writes the Metrics to the given io.Writer with the given
+// resolution in the InfluxDB line protocol. Each sample is written as
+//
+//	measurement,label=value name=value timestamp
+//
+// with labels as tags, the metric name as field and timestamps in nanoseconds.
+//
+// See https://docs.influxdata.com/influxdb/v2/reference/syntax/line-protocol/
+func (m *Metrics) WriteInflux(w io.Writer, measurement string, resolution time.Duration, opts ...WriteOption) error {
+	measurement = influxMeasurementEscaper.Replace(measurement)
+	// Tags are the same for all samples of a series, so they are rendered once.
+	tags := map[string]string{}
+	return m.rec.Walk(resolution, newWriteOptions(opts), func(s series, value float64, at time.Time) error {
+		name := s.String()
+		t, ok := tags[name]
+		if !ok {
+			t = influxTags(s.labels)
+			tags[name] = t
+		}
+		_, err := fmt.Fprintf(w, "%s%s %s=%s %d\n", measurement, t, influxKeyEscaper.Replace(s.name), formatValue(value), at.UnixNano())
+		return err
+	})
+}
+
+// influxTags renders labels as tags sorted by key, as recommended by InfluxDB.
+// Labels with empty values are skipped, as InfluxDB does not support them.
+func influxTags(l labels) string {
+	sorted := slices.Clone(l)
+	slices.SortStableFunc(sorted, func(a, b label) int {
+		return cmp.Compare(a.key, b.key)
+	})
+	var s strings.Builder
+	for _, label := range sorted {
+		if label.value == "" {
+			continue
+		}
+		s.WriteByte(',')
+		s.WriteString(influxKeyEscaper.Replace(label.key))
+		s.WriteByte('=')
+		s.WriteString(influxKeyEscaper.Replace(label.value))
+	}
+	return s.String()
+}
@@ -0,0 +1,29 @@
+package backfill
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWriteInflux(t *testing.T) {
+	start := time.Unix(1724512000, 0)
+
+	m := NewMetrics().With("sender", "Bob, the builder").With("file", "a=b.json")
+	m.Metric("tg_messages_total").Inc(1, start)
+	m.Metric("tg_messages_total").Inc(1, start.Add(10*time.Second))
+
+	var b strings.Builder
+	if err := m.WriteInflux(&b, "tg stat", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	got := b.String()
+	want := `tg\ stat,file=a\=b.json,sender=Bob\,\ the\ builder tg_messages_total=1 1724512000000000000` + "\n"
+	want += `tg\ stat,file=a\=b.json,sender=Bob\,\ the\ builder tg_messages_total=2 1724512010000000000` + "\n"
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
@@ -0,0 +1,43 @@
+package backfill
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// jsonSeries is a time series as written by WriteJSON.
+type jsonSeries struct {
+	Metric  string            `json:"metric"`
+	Labels  map[string]string `json:"labels"`
+	Samples []jsonSample      `json:"samples"`
+}
+
+// jsonSample is a single sample of a jsonSeries.
+type jsonSample struct {
+	T int64   `json:"t"`
+	V float64 `json:"v"`
+}
+
+// WriteJSON writes the Metrics to the given io.Writer with the given resolution
+// as a JSON array with one object per series:
+//
+//	{"metric": name, "labels": {key: value}, "samples": [{"t": unix, "v": value}]}
+//
+// Series are ordered like the lines written by Write.
+func (m *Metrics) WriteJSON(w io.Writer, resolution time.Duration, opts ...WriteOption) error {
+	all, err := m.Series(resolution, opts...)
+	if err != nil {
+		return err
+	}
+
+	result := make([]jsonSeries, len(all))
+	for i, s := range all {
+		samples := make([]jsonSample, len(s.Points))
+		for j, p := range s.Points {
+			samples[j] = jsonSample{T: p.Time.Unix(), V: p.Value}
+		}
+		result[i] = jsonSeries{Metric: s.Name, Labels: s.Labels, Samples: samples}
+	}
+	return json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,57 @@
+package backfill
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWriteJSON(t *testing.T) {
+	start := time.Unix(1724512000, 0)
+
+	m := NewMetrics().With("x", "foo")
+	m.Metric("qux").Inc(1, start)
+	m.Metric("qux").Inc(2, start.Add(20*time.Second))
+	m.With("a", "bar").Metric("zot").Inc(5, start.Add(10*time.Second))
+
+	var b strings.Builder
+	if err := m.WriteJSON(&b, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	var got []jsonSeries
+	if err := json.Unmarshal([]byte(b.String()), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []jsonSeries{
+		{
+			Metric:  "qux",
+			Labels:  map[string]string{"x": "foo"},
+			Samples: []jsonSample{{1724512000, 1}, {1724512010, 1}, {1724512020, 3}},
+		},
+		{
+			Metric:  "zot",
+			Labels:  map[string]string{"a": "bar", "x": "foo"},
+			Samples: []jsonSample{{1724512010, 5}, {1724512020, 5}},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+
+	// Every line written by Write is a sample in the JSON output.
+	var text strings.Builder
+	if err := m.Write(&text, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	var samples int
+	for _, s := range got {
+		samples += len(s.Samples)
+	}
+	if lines := strings.Count(text.String(), "\n"); samples != lines {
+		t.Errorf("got %d samples, want %d as written by Write", samples, lines)
+	}
+}
@@ -0,0 +1,170 @@
+package backfill
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+)
+
+// Merge adds the series recorded by other to the Metrics, so that recordings
+// of separate runs can be written together. Series are identified by their
+// name and labels. Like Len, it applies to all Metrics that share the same
+// origin, regardless of their labels.
+//
+// Counters present in both are summed at every point in time. Gauges recorded
+// with Set take the latest value of either, preferring other at equal times,
+// and those recorded with Max or Min the larger or smaller value of either.
+// Distinct and summary series combine the members and digests of both,
+// so members of DistinctTotal series seen by both count once.
+//
+// The series of other count towards the limit set with LimitCardinality, so
+// that merged Metrics are limited like recorded ones.
+func (m *Metrics) Merge(other *Metrics) error {
+	if m.rec == other.rec {
+		return errors.New("merge: metrics share the same recorder")
+	}
+	if err := m.rec.Merge(other.rec); err != nil {
+		return fmt.Errorf("merge: %w", err)
+	}
+	m.meta.merge(other.meta)
+	return nil
+}
+
+func (r *linkedListRecorder) Merge(other recorder) error {
+	o, ok := other.(*linkedListRecorder)
+	if !ok {
+		return fmt.Errorf("unsupported recorder %T", other)
+	}
+
+	// Copy the series of o first, so that only one lock is held at a time.
+	o.mu.Lock()
+	series := maps.Clone(o.series)
+	first := maps.Clone(o.first)
+	sightings := make(map[string][]sighting, len(o.sightings))
+	for name, s := range o.sightings {
+		sightings[name] = append([]sighting(nil), s...)
+	}
+	perStep := maps.Clone(o.perStep)
+	kinds := maps.Clone(o.kinds)
+	totals := maps.Clone(o.totals)
+	digests := make(map[string][]stepDigest, len(o.digests))
+	for name, steps := range o.digests {
+		for _, sd := range steps {
+			sd.digest = sd.digest.clone()
+			digests[name] = append(digests[name], sd)
+		}
+	}
+	quantiles := maps.Clone(o.quantiles)
+	overflowed := maps.Clone(o.overflowed)
+	o.mu.Unlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	maps.Copy(r.overflowed, overflowed)
+	// Series of o are limited like recorded ones. Series beyond the limit
+	// are merged into the overflow series, so names are sorted to make it
+	// deterministic which ones.
+	for _, name := range slices.Sorted(maps.Keys(series)) {
+		s := r.limit(series[name])
+		key := s.String()
+		r.series[key] = s
+		if s, ok := sightings[name]; ok {
+			r.sightings[key] = append(r.sightings[key], s...)
+			if totals[name] {
+				r.totals[key] = true
+			}
+			continue
+		}
+		if steps, ok := digests[name]; ok {
+			for _, o := range steps {
+				sd := r.stepDigest(key, o.at)
+				if o.first.Before(sd.first) {
+					sd.first = o.first
+				}
+				if o.last.After(sd.last) {
+					sd.last = o.last
+				}
+				sd.digest.merge(o.digest)
+			}
+			r.quantiles[key] = quantiles[name]
+			continue
+		}
+		kind := max(r.kinds[key], kinds[name])
+		r.first[key], r.current[key] = mergeRecords(r.first[key], first[name], kind)
+		if perStep[name] {
+			r.perStep[key] = true
+		}
+		if kind != counterKind {
+			r.kinds[key] = kind
+		}
+	}
+	return nil
+}
+
+// mergeRecords returns a new list with a record at every time of the lists a
+// and b and its first and last record. The value of a counter is the sum of
+// both lists, since their values are cumulative. The value of a gauge is the
+// value of the latest record of either list, preferring b at equal times. The
+// value of a maximum or minimum is the larger or smaller value of the lists
+// that have started.
+func mergeRecords(a, b *record, kind recordKind) (first, last *record) {
+	var va, vb float64
+	var startedA, startedB bool
+	for a != nil || b != nil {
+		var at time.Time
+		switch {
+		case a == nil:
+			at = b.at
+		case b == nil || a.at.Before(b.at):
+			at = a.at
+		default:
+			at = b.at
+		}
+
+		rec := &record{at: at}
+		if a != nil && a.at.Equal(at) {
+			va, rec.value = a.value, a.value
+			startedA = true
+			a = a.next
+		}
+		if b != nil && b.at.Equal(at) {
+			vb, rec.value = b.value, b.value
+			startedB = true
+			b = b.next
+		}
+		switch kind {
+		case counterKind:
+			rec.value = va + vb
+		case maxKind, minKind:
+			if startedA && startedB {
+				rec.value = kind.extreme(va, vb)
+			}
+		}
+
+		if first == nil {
+			first = rec
+		} else {
+			last.next = rec
+		}
+		last = rec
+	}
+	return first, last
+}
+
+// merge adds the descriptions of other that are not described in m.
+func (m *metadata) merge(other *metadata) {
+	other.mu.Lock()
+	families := maps.Clone(other.families)
+	other.mu.Unlock()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name, d := range families {
+		if _, ok := m.families[name]; !ok {
+			m.families[name] = d
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package backfill
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMetricsMerge(t *testing.T) {
+	start := time.Unix(1724512000, 0)
+
+	a := NewMetrics()
+	a.Metric("both").Inc(1, start)
+	a.Metric("both").Inc(1, start.Add(20*time.Second))
+	a.Metric("only_a").Inc(3, start.Add(10*time.Second))
+	a.Metric("gauge").Set(5, start)
+	a.Metric("gauge").Set(6, start.Add(20*time.Second))
+	a.Metric("distinct").Distinct("alice", start)
+
+	b := NewMetrics()
+	b.Metric("both").Inc(2, start.Add(10*time.Second))
+	b.Metric("both").Inc(2, start.Add(20*time.Second))
+	b.With("sender", "bob").Metric("only_b").Inc(4, start)
+	b.Metric("gauge").Set(7, start.Add(10*time.Second))
+	b.Metric("distinct").Distinct("alice", start)
+	b.Metric("distinct").Distinct("bob", start)
+	b.Metric("distinct").Distinct("bob", start.Add(10*time.Second))
+
+	if err := a.Merge(b); err != nil {
+		t.Fatal(err)
+	}
+	var buf strings.Builder
+	if err := a.Write(&buf, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	want := strings.Join([]string{
+		"both 1 1724512000",
+		"distinct 2 1724512000",
+		"gauge 5 1724512000",
+		`only_b{sender="bob"} 4 1724512000`,
+		"both 3 1724512010",
+		"distinct 1 1724512010",
+		"gauge 7 1724512010",
+		"only_a 3 1724512010",
+		`only_b{sender="bob"} 4 1724512010`,
+		"both 6 1724512020",
+		"distinct 0 1724512020",
+		"gauge 6 1724512020",
+		"only_a 3 1724512020",
+		`only_b{sender="bob"} 4 1724512020`,
+		"",
+	}, "\n")
+	if diff := cmp.Diff(want, buf.String()); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+
+	// The recording of b is unchanged.
+	if got, want := b.Len(), 4; got != want {
+		t.Errorf("got %d series in b, want %d", got, want)
+	}
+	if err := a.Merge(a.With("sender", "alice")); err == nil {
+		t.Error("want error merging metrics into themselves")
+	}
+}
+
+func TestMetricsMergeDistinctTotal(t *testing.T) {
+	start := time.Unix(1724512000, 0)
+
+	a := NewMetrics()
+	a.Metric("days").DistinctTotal("2024-08-24", start)
+	b := NewMetrics()
+	b.Metric("days").DistinctTotal("2024-08-24", start.Add(10*time.Second))
+	b.Metric("days").DistinctTotal("2024-08-25", start.Add(20*time.Second))
+
+	if err := a.Merge(b); err != nil {
+		t.Fatal(err)
+	}
+	var buf strings.Builder
+	if err := a.Write(&buf, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// The day seen by both counts once.
+	want := "days 1 1724512000\ndays 1 1724512010\ndays 2 1724512020\n"
+	if diff := cmp.Diff(want, buf.String()); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
+
+func TestMetricsMergeMax(t *testing.T) {
+	start := time.Unix(1724512000, 0)
+
+	a := NewMetrics()
+	a.Metric("longest").Max(10, start)
+	a.Metric("longest").Max(43, start.Add(20*time.Second))
+	b := NewMetrics()
+	b.Metric("longest").Max(2, start.Add(10*time.Second))
+	b.Metric("longest").Max(3, start.Add(30*time.Second))
+
+	if err := a.Merge(b); err != nil {
+		t.Fatal(err)
+	}
+	var buf strings.Builder
+	if err := a.Write(&buf, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	want := "longest 10 1724512000\nlongest 10 1724512010\nlongest 43 1724512020\nlongest 43 1724512030\n"
+	if diff := cmp.Diff(want, buf.String()); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
+
+func TestMetricsMergeLimitCardinality(t *testing.T) {
+	at := time.Unix(1724512000, 0)
+
+	a := NewMetrics()
+	a.LimitCardinality(2)
+	a.Metric("messages").With("sender", "Alice").Inc(1, at)
+	b := NewMetrics()
+	b.LimitCardinality(2)
+	for _, sender := range []string{"Bob", "Carol", "Dave", "Alice"} {
+		b.Metric("messages").With("sender", sender).Inc(1, at)
+	}
+
+	if err := a.Merge(b); err != nil {
+		t.Fatal(err)
+	}
+	var buf strings.Builder
+	if err := a.Write(&buf, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// b records Bob and Carol, and Dave and Alice in its overflow series. Only
+	// Bob fits into the limit of a, so Carol and the overflow series of b go
+	// to the overflow series of a, which does not count towards the limit.
+	want := "messages{sender=\"Alice\"} 1 1724512000\n"
+	want += "messages{sender=\"Bob\"} 1 1724512000\n"
+	want += "messages{sender=\"__other__\"} 3 1724512000\n"
+	if diff := cmp.Diff(want, buf.String()); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"messages"}, a.Overflowed()); diff != "" {
+		t.Errorf("overflowed diff -want +got:\n%s", diff)
+	}
+}
@@ -0,0 +1,159 @@
+package backfill
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricType is the type of a metric family as defined by OpenMetrics.
+type MetricType string
+
+const (
+	Unknown   MetricType = "unknown"
+	Counter   MetricType = "counter"
+	Gauge     MetricType = "gauge"
+	Histogram MetricType = "histogram"
+	Summary   MetricType = "summary"
+)
+
+// Describe sets the type and help text of the metric family, which are written
+// by WriteOpenMetrics. The description applies to the metric regardless of
+// its labels. Names of counters must end with _total.
+func (m *Metric) Describe(typ MetricType, help string) *Metric {
+	m.meta.describe(m.name, typ, help)
+	return m
+}
+
+// metadata holds the descriptions of metric families. It is shared by all
+// Metrics and Metric instances of a recorder and is safe for concurrent use.
+type metadata struct {
+	mu       sync.Mutex
+	families map[string]description // keyed by family name
+}
+
+// description is the type and help text of a metric family.
+type description struct {
+	typ  MetricType
+	help string
+}
+
+func newMetadata() *metadata {
+	return &metadata{families: make(map[string]description)}
+}
+
+func (m *metadata) describe(name string, typ MetricType, help string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if typ == Counter {
+		// The family of counters is named without the suffix of its samples.
+		name = strings.TrimSuffix(name, "_total")
+	}
+	m.families[name] = description{typ, help}
+}
+
+// family returns the name and description of the family of the sample name.
+// Samples of undescribed metrics are families of type Unknown on their own.
+func (m *metadata) family(sample string) (string, description) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for suffix, types := range map[string][]MetricType{
+		"_total":  {Counter},
+		"_bucket": {Histogram},
+		"_count":  {Histogram, Summary},
+		"_sum":    {Histogram, Summary},
+	} {
+		name, ok := strings.CutSuffix(sample, suffix)
+		if d := m.families[name]; ok && slices.Contains(types, d.typ) {
+			return name, d
+		}
+	}
+	if d, ok := m.families[sample]; ok {
+		return sample, d
+	}
+	return sample, description{typ: Unknown}
+}
+
+// WriteOpenMetrics writes the Metrics to the given io.Writer with the given
+// resolution in the OpenMetrics text format. The samples of each metric family
+// are preceded by its # TYPE and # HELP lines, see Metric.Describe, and the
+// output ends with # EOF.
+//
+// Unlike Write, samples are grouped by family and series, as required by the
+// format, so all samples are kept in memory.
+//
+// See https://github.com/prometheus/OpenMetrics/blob/main/specification/OpenMetrics.md
+func (m *Metrics) WriteOpenMetrics(w io.Writer, resolution time.Duration, opts ...WriteOption) error {
+	type sample struct {
+		s      series
+		family string
+		metric string  // series without le or quantile label, shared by the samples of a histogram or summary
+		rank   int     // order of the samples of a histogram or summary at the same time
+		le     float64 // or quantile
+		value  float64
+		at     time.Time
+	}
+	var samples []sample
+	err := m.rec.Walk(resolution, newWriteOptions(opts), func(s series, value float64, at time.Time) error {
+		family, d := m.meta.family(s.name)
+		smp := sample{s: s, family: family, value: value, at: at}
+		var rest labels
+		for _, l := range s.labels {
+			if l.key == "le" && strings.HasSuffix(s.name, "_bucket") || l.key == "quantile" && d.typ == Summary && s.name == family {
+				smp.le, _ = strconv.ParseFloat(l.value, 64)
+				continue
+			}
+			rest = append(rest, l)
+		}
+		smp.metric = rest.String()
+		switch {
+		case strings.HasSuffix(s.name, "_count"):
+			smp.rank = 1
+		case strings.HasSuffix(s.name, "_sum"):
+			smp.rank = 2
+		}
+		samples = append(samples, smp)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Walk returns samples ordered by time, so the stable sort keeps
+	// the samples of each series in order.
+	slices.SortStableFunc(samples, func(a, b sample) int {
+		return cmp.Or(
+			cmp.Compare(a.family, b.family),
+			cmp.Compare(a.metric, b.metric),
+			a.at.Compare(b.at),
+			cmp.Compare(a.rank, b.rank),
+			cmp.Compare(a.le, b.le),
+		)
+	})
+
+	var family string
+	for _, smp := range samples {
+		if smp.family != family {
+			family = smp.family
+			_, d := m.meta.family(smp.s.name)
+			if _, err := fmt.Fprintf(w, "# TYPE %s %s\n", family, d.typ); err != nil {
+				return err
+			}
+			if d.help != "" {
+				if _, err := fmt.Fprintf(w, "# HELP %s %s\n", family, labelValueEscaper.Replace(d.help)); err != nil {
+					return err
+				}
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s %s %d\n", smp.s, formatValue(smp.value), smp.at.Unix()); err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(w, "# EOF\n")
+	return err
+}
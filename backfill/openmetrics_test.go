@@ -0,0 +1,60 @@
+package backfill
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWriteOpenMetrics(t *testing.T) {
+	start := time.Unix(1724512000, 0)
+
+	m := NewMetrics()
+	m.Metric("messages_total").Describe(Counter, "Number of messages.")
+	m.Metric("senders").Describe(Gauge, "Number of \"active\" senders.\nPer step.")
+	m.Metric("length").Describe(Histogram, "")
+
+	alice := m.With("sender", "Alice")
+	alice.Metric("messages_total").Inc(1, start)
+	m.With("sender", "Bob").Metric("messages_total").Inc(2, start.Add(time.Hour))
+	alice.Metric("messages_total").Inc(1, start.Add(time.Hour))
+	m.Metric("senders").Distinct("Alice", start)
+	alice.Metric("length").Buckets(10, 100).Observe(42, start)
+	m.Metric("undescribed").Set(3, start)
+
+	var b strings.Builder
+	if err := m.WriteOpenMetrics(&b, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	got := b.String()
+	want := "# TYPE length histogram\n"
+	want += "length_bucket{le=\"10\",sender=\"Alice\"} 0 1724512000\n"
+	want += "length_bucket{le=\"100\",sender=\"Alice\"} 1 1724512000\n"
+	want += "length_bucket{le=\"+Inf\",sender=\"Alice\"} 1 1724512000\n"
+	want += "length_count{sender=\"Alice\"} 1 1724512000\n"
+	want += "length_sum{sender=\"Alice\"} 42 1724512000\n"
+	want += "length_bucket{le=\"10\",sender=\"Alice\"} 0 1724515600\n"
+	want += "length_bucket{le=\"100\",sender=\"Alice\"} 1 1724515600\n"
+	want += "length_bucket{le=\"+Inf\",sender=\"Alice\"} 1 1724515600\n"
+	want += "length_count{sender=\"Alice\"} 1 1724515600\n"
+	want += "length_sum{sender=\"Alice\"} 42 1724515600\n"
+	want += "# TYPE messages counter\n"
+	want += "# HELP messages Number of messages.\n"
+	want += "messages_total{sender=\"Alice\"} 1 1724512000\n"
+	want += "messages_total{sender=\"Alice\"} 2 1724515600\n"
+	want += "messages_total{sender=\"Bob\"} 2 1724515600\n"
+	want += "# TYPE senders gauge\n"
+	want += "# HELP senders Number of \\\"active\\\" senders.\\nPer step.\n"
+	want += "senders 1 1724512000\n"
+	want += "senders 0 1724515600\n"
+	want += "# TYPE undescribed unknown\n"
+	want += "undescribed 3 1724512000\n"
+	want += "undescribed 3 1724515600\n"
+	want += "# EOF\n"
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
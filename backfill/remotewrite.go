@@ -0,0 +1,95 @@
+package backfill
+
+import (
+	"cmp"
+	"encoding/binary"
+	"io"
+	"math"
+	"slices"
+	"time"
+)
+
+// WriteRemoteWrite writes the Metrics to the given io.Writer with the given
+// resolution as a snappy-compressed Prometheus remote write request.
+//
+// See https://prometheus.io/docs/concepts/remote_write_spec/
+func (m *Metrics) WriteRemoteWrite(w io.Writer, resolution time.Duration, opts ...WriteOption) error {
+	// Samples are grouped by series in the order the series first appear.
+	var order []string
+	timeSeries := map[string][]byte{}
+	err := m.rec.Walk(resolution, newWriteOptions(opts), func(s series, value float64, at time.Time) error {
+		name := s.String()
+		ts, ok := timeSeries[name]
+		if !ok {
+			order = append(order, name)
+			ts = appendRemoteWriteLabels(ts, s)
+		}
+		timeSeries[name] = protoAppendBytes(ts, 2, appendRemoteWriteSample(nil, value, at))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var req []byte
+	for _, name := range order {
+		req = protoAppendBytes(req, 1, timeSeries[name])
+	}
+	_, err = w.Write(snappyEncode(req))
+	return err
+}
+
+// appendRemoteWriteLabels appends the labels of s, including the metric name
+// as __name__, to a TimeSeries message. Labels are sorted by name as
+// required by the protocol.
+func appendRemoteWriteLabels(b []byte, s series) []byte {
+	l := append(labels{{"__name__", s.name}}, s.labels...)
+	slices.SortStableFunc(l, func(a, b label) int {
+		return cmp.Compare(a.key, b.key)
+	})
+	for _, label := range l {
+		var msg []byte
+		msg = protoAppendString(msg, 1, label.key)
+		msg = protoAppendString(msg, 2, label.value)
+		b = protoAppendBytes(b, 1, msg)
+	}
+	return b
+}
+
+// appendRemoteWriteSample appends the fields of a Sample message.
+func appendRemoteWriteSample(b []byte, value float64, at time.Time) []byte {
+	b = protoAppendDouble(b, 1, value)
+	return protoAppendVarint(b, 2, uint64(at.UnixMilli()))
+}
+
+// Protocol buffer wire types.
+// See https://protobuf.dev/programming-guides/encoding/
+const (
+	protoVarint = 0
+	protoI64    = 1
+	protoLen    = 2
+)
+
+func protoAppendTag(b []byte, field, wireType int) []byte {
+	return binary.AppendUvarint(b, uint64(field<<3|wireType))
+}
+
+func protoAppendVarint(b []byte, field int, v uint64) []byte {
+	b = protoAppendTag(b, field, protoVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+func protoAppendDouble(b []byte, field int, v float64) []byte {
+	b = protoAppendTag(b, field, protoI64)
+	return binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+}
+
+func protoAppendBytes(b []byte, field int, v []byte) []byte {
+	b = protoAppendTag(b, field, protoLen)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func protoAppendString(b []byte, field int, v string) []byte {
+	return protoAppendBytes(b, field, []byte(v))
+}
@@ -0,0 +1,202 @@
+package backfill
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type testSample struct {
+	Value     float64
+	Timestamp int64
+}
+
+type testTimeSeries struct {
+	Labels  map[string]string
+	Samples []testSample
+}
+
+func TestWriteRemoteWrite(t *testing.T) {
+	start := time.Unix(1724512000, 0)
+
+	m := NewMetrics().With("x", "foo")
+	m.Metric("qux").Inc(1, start)
+	m.Metric("qux").Inc(2, start.Add(20*time.Second))
+	m.With("a", "bar").Metric("zot").Inc(5, start.Add(10*time.Second))
+
+	var b bytes.Buffer
+	if err := m.WriteRemoteWrite(&b, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := snappyDecode(b.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeWriteRequest(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ms := start.UnixMilli()
+	want := []testTimeSeries{
+		{
+			Labels: map[string]string{"__name__": "qux", "x": "foo"},
+			Samples: []testSample{
+				{1, ms},
+				{1, ms + 10_000},
+				{3, ms + 20_000},
+			},
+		},
+		{
+			Labels: map[string]string{"__name__": "zot", "a": "bar", "x": "foo"},
+			Samples: []testSample{
+				{5, ms + 10_000},
+				{5, ms + 20_000},
+			},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
+
+func TestSnappyRoundTrip(t *testing.T) {
+	for _, in := range []string{
+		"",
+		"a",
+		"abcdefgh",
+		strings.Repeat("tg_messages_total{sender=\"Alice\"} ", 5000),
+		strings.Repeat("x", 200_000),
+	} {
+		got, err := snappyDecode(snappyEncode([]byte(in)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != in {
+			t.Errorf("round trip of %d bytes failed", len(in))
+		}
+	}
+}
+
+// snappyDecode decodes the snappy block format.
+func snappyDecode(src []byte) ([]byte, error) {
+	n, l := binary.Uvarint(src)
+	if l <= 0 {
+		return nil, fmt.Errorf("invalid length")
+	}
+	src = src[l:]
+	dst := make([]byte, 0, n)
+	for len(src) > 0 {
+		tag := src[0]
+		switch tag & 3 {
+		case 0: // literal
+			length := int(tag >> 2)
+			src = src[1:]
+			if length >= 60 {
+				extra := length - 59
+				length = 0
+				for i := range extra {
+					length |= int(src[i]) << (8 * i)
+				}
+				src = src[extra:]
+			}
+			length++
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+		case 1: // copy with 1-byte offset
+			length := int(tag>>2&7) + 4
+			offset := int(tag>>5)<<8 | int(src[1])
+			src = src[2:]
+			for range length {
+				dst = append(dst, dst[len(dst)-offset])
+			}
+		case 2: // copy with 2-byte offset
+			length := int(tag>>2) + 1
+			offset := int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+			for range length {
+				dst = append(dst, dst[len(dst)-offset])
+			}
+		default:
+			return nil, fmt.Errorf("unsupported tag %d", tag&3)
+		}
+	}
+	if uint64(len(dst)) != n {
+		return nil, fmt.Errorf("got %d bytes, want %d", len(dst), n)
+	}
+	return dst, nil
+}
+
+type protoField struct {
+	num    int
+	varint uint64
+	bytes  []byte
+}
+
+// decodeProto decodes the fields of a protocol buffer message.
+func decodeProto(b []byte) ([]protoField, error) {
+	var fields []protoField
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid tag")
+		}
+		b = b[n:]
+		f := protoField{num: int(tag >> 3)}
+		switch tag & 7 {
+		case protoVarint:
+			f.varint, n = binary.Uvarint(b)
+			b = b[n:]
+		case protoI64:
+			f.varint = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case protoLen:
+			l, n := binary.Uvarint(b)
+			f.bytes = b[n : n+int(l)]
+			b = b[n+int(l):]
+		default:
+			return nil, fmt.Errorf("unsupported wire type %d", tag&7)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+func decodeWriteRequest(b []byte) ([]testTimeSeries, error) {
+	req, err := decodeProto(b)
+	if err != nil {
+		return nil, err
+	}
+	var result []testTimeSeries
+	for _, f := range req {
+		tsFields, err := decodeProto(f.bytes)
+		if err != nil {
+			return nil, err
+		}
+		ts := testTimeSeries{Labels: map[string]string{}}
+		for _, tf := range tsFields {
+			fields, err := decodeProto(tf.bytes)
+			if err != nil {
+				return nil, err
+			}
+			switch tf.num {
+			case 1: // Label
+				ts.Labels[string(fields[0].bytes)] = string(fields[1].bytes)
+			case 2: // Sample
+				ts.Samples = append(ts.Samples, testSample{
+					Value:     math.Float64frombits(fields[0].varint),
+					Timestamp: int64(fields[1].varint),
+				})
+			}
+		}
+		result = append(result, ts)
+	}
+	return result, nil
+}
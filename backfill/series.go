@@ -0,0 +1,45 @@
+package backfill
+
+import "time"
+
+// Series is a recorded time series with its samples, see Metrics.Series.
+type Series struct {
+	Name   string
+	Labels map[string]string
+	Points []Point
+}
+
+// Point is a sample of a Series.
+type Point struct {
+	Time  time.Time
+	Value float64
+}
+
+// Series returns the recorded series with their samples at the given
+// resolution, i.e. the samples written by Write, grouped by series. Series are
+// ordered like the lines written by Write. The returned series are copies, so
+// changing them does not affect the Metrics.
+func (m *Metrics) Series(resolution time.Duration, opts ...WriteOption) ([]Series, error) {
+	// Samples are grouped by series in the order the series first appear.
+	var result []Series
+	index := map[string]int{}
+	err := m.rec.Walk(resolution, newWriteOptions(opts), func(s series, value float64, at time.Time) error {
+		name := s.String()
+		i, ok := index[name]
+		if !ok {
+			labels := make(map[string]string, len(s.labels))
+			for _, l := range s.labels {
+				labels[l.key] = l.value
+			}
+			i = len(result)
+			index[name] = i
+			result = append(result, Series{Name: s.name, Labels: labels})
+		}
+		result[i].Points = append(result[i].Points, Point{Time: at, Value: value})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
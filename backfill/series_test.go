@@ -0,0 +1,42 @@
+package backfill
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMetricsSeries(t *testing.T) {
+	start := time.Unix(1724512000, 0)
+
+	m := NewMetrics()
+	m.With("sender", "Alice").Metric("messages_total").Inc(1, start)
+	m.With("sender", "Alice").Metric("messages_total").Inc(2, start.Add(time.Hour))
+	m.Metric("senders").Set(1, start.Add(time.Hour))
+
+	got, err := m.Series(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Series{
+		{
+			Name:   "messages_total",
+			Labels: map[string]string{"sender": "Alice"},
+			Points: []Point{
+				{start, 1},
+				{start.Add(time.Hour), 3},
+			},
+		},
+		{
+			Name:   "senders",
+			Labels: map[string]string{},
+			Points: []Point{
+				{start.Add(time.Hour), 1},
+			},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
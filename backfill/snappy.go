@@ -0,0 +1,90 @@
+package backfill
+
+import (
+	"encoding/binary"
+)
+
+// snappyEncode compresses src using the snappy block format, as required by
+// the Prometheus remote write protocol. It is a simple greedy compressor
+// that trades compression ratio for brevity.
+//
+// See https://github.com/google/snappy/blob/main/format_description.txt
+func snappyEncode(src []byte) []byte {
+	dst := binary.AppendUvarint(nil, uint64(len(src)))
+	// Copy offsets are limited to 16 bits, so matches are searched in blocks.
+	for len(src) > 0 {
+		n := min(len(src), snappyMaxBlockSize)
+		dst = snappyEncodeBlock(dst, src[:n])
+		src = src[n:]
+	}
+	return dst
+}
+
+const (
+	snappyMaxBlockSize = 1 << 16
+	snappyTableBits    = 14
+	snappyMinMatch     = 4
+)
+
+func snappyEncodeBlock(dst, src []byte) []byte {
+	// table holds the position+1 of the last occurrence of a hashed 4-byte sequence.
+	var table [1 << snappyTableBits]int32
+
+	var lit int // start of the pending literal
+	for i := 0; i+snappyMinMatch <= len(src); {
+		cur := binary.LittleEndian.Uint32(src[i:])
+		h := (cur * 0x1e35a7bd) >> (32 - snappyTableBits)
+		candidate := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if candidate < 0 || binary.LittleEndian.Uint32(src[candidate:]) != cur {
+			i++
+			continue
+		}
+
+		n := snappyMinMatch
+		for i+n < len(src) && src[candidate+n] == src[i+n] {
+			n++
+		}
+		dst = snappyEmitLiteral(dst, src[lit:i])
+		dst = snappyEmitCopy(dst, i-candidate, n)
+		i += n
+		lit = i
+	}
+	return snappyEmitLiteral(dst, src[lit:])
+}
+
+func snappyEmitLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+	switch n := uint32(len(lit) - 1); {
+	case n < 60:
+		dst = append(dst, byte(n)<<2)
+	case n < 1<<8:
+		dst = append(dst, 60<<2, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+func snappyEmitCopy(dst []byte, offset, length int) []byte {
+	// Copies are limited to 64 bytes. Emit in chunks but never leave less
+	// than 4 bytes for the last chunk.
+	for length >= 68 {
+		dst = append(dst, 63<<2|2, byte(offset), byte(offset>>8))
+		length -= 64
+	}
+	if length > 64 {
+		dst = append(dst, 59<<2|2, byte(offset), byte(offset>>8))
+		length -= 60
+	}
+	if length >= 12 || offset >= 2048 {
+		return append(dst, byte(length-1)<<2|2, byte(offset), byte(offset>>8))
+	}
+	return append(dst, byte(offset>>8)<<5|byte(length-4)<<2|1, byte(offset))
+}
@@ -0,0 +1,18 @@
+package backfill
+
+import "slices"
+
+// Quantiles returns a copy of the Metric that records observations into a
+// summary with the given quantiles, e.g. 0.5 for the median, instead of a
+// histogram. See Observe.
+func (m *Metric) Quantiles(quantiles ...float64) *Metric {
+	qs := slices.Clone(quantiles)
+	slices.Sort(qs)
+	return &Metric{
+		name:      m.name,
+		labels:    m.labels,
+		rec:       m.rec,
+		meta:      m.meta,
+		quantiles: qs,
+	}
+}
@@ -0,0 +1,154 @@
+package backfill
+
+import (
+	"math"
+	"math/rand/v2"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMetricObserveQuantiles(t *testing.T) {
+	start := time.Unix(1724512000, 0)
+
+	m := NewMetrics(SummaryResolution(10 * time.Second))
+	length := m.Metric("len").Quantiles(0.99, 0.5, 0.9)
+	// The values 1 to 1000 in random order, then 1001 to 2000 in the next step.
+	rng := rand.New(rand.NewPCG(1, 2))
+	for step := range 2 {
+		for _, i := range rng.Perm(1000) {
+			length.Observe(float64(step*1000+i+1), start.Add(time.Duration(step)*10*time.Second))
+		}
+	}
+
+	all, err := m.Series(10 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string][]float64{}
+	for _, s := range all {
+		key := s.Name
+		if q, ok := s.Labels["quantile"]; ok {
+			key += "/" + q
+		}
+		for _, p := range s.Points {
+			got[key] = append(got[key], p.Value)
+		}
+	}
+
+	// The exact quantiles of the observations up to each step.
+	want := map[string][]float64{
+		"len/0.5":   {500, 1000},
+		"len/0.9":   {900, 1800},
+		"len/0.99":  {990, 1980},
+		"len_count": {1000, 2000},
+		"len_sum":   {500500, 2001000},
+	}
+	if diff := cmp.Diff(want, got, cmp.Comparer(func(a, b float64) bool {
+		return math.Abs(a-b) <= 0.01*max(a, b)
+	})); diff != "" {
+		t.Errorf("diff -want +got (1%% tolerance):\n%s", diff)
+	}
+}
+
+func TestTDigest(t *testing.T) {
+	d := newTDigest(summaryCompression)
+	if got := d.quantile(0.5); !math.IsNaN(got) {
+		t.Errorf("got %v for empty digest, want NaN", got)
+	}
+
+	const n = 100000
+	rng := rand.New(rand.NewPCG(1, 2))
+	for range n {
+		d.add(rng.NormFloat64())
+	}
+	if got := len(d.centroids) + len(d.buffer); got > 10*summaryCompression {
+		t.Errorf("got %d centroids for %d values, want memory bounded by compression", got, n)
+	}
+
+	// Quantiles of the standard normal distribution.
+	for q, want := range map[float64]float64{
+		0.01: -2.326,
+		0.1:  -1.282,
+		0.5:  0,
+		0.9:  1.282,
+		0.99: 2.326,
+	} {
+		if got := d.quantile(q); math.Abs(got-want) > 0.02 {
+			t.Errorf("quantile(%v): got %.3f, want %.3f", q, got, want)
+		}
+	}
+	if got, want := d.quantile(0), d.min; got != want {
+		t.Errorf("quantile(0): got %v, want minimum %v", got, want)
+	}
+	if got, want := d.quantile(1), d.max; got != want {
+		t.Errorf("quantile(1): got %v, want maximum %v", got, want)
+	}
+}
+
+func TestSummaryBoundedMemory(t *testing.T) {
+	start := time.Unix(1724515200, 0)
+
+	m := NewMetrics()
+	length := m.Metric("len").Quantiles(0.5)
+	for i := range 30000 {
+		length.Observe(float64(i), start.Add(time.Duration(i%3)*time.Hour+time.Minute))
+	}
+
+	rec := m.rec.(*linkedListRecorder)
+	steps := rec.digests["len"]
+	if got, want := len(steps), 3; got != want {
+		t.Fatalf("got %d step digests, want %d", got, want)
+	}
+	for _, sd := range steps {
+		if got := len(sd.digest.centroids) + len(sd.digest.buffer); got > 10*summaryCompression {
+			t.Errorf("got %d centroids in step %v, want memory bounded by compression", got, sd.at)
+		}
+	}
+
+	// Quantiles are known as of the end of the step of the observations.
+	all, err := m.Series(time.Hour, AlignToResolution())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []time.Time
+	for _, s := range all {
+		if s.Labels["quantile"] == "0.5" {
+			for _, p := range s.Points {
+				got = append(got, p.Time)
+			}
+		}
+	}
+	want := []time.Time{start.Add(time.Hour), start.Add(2 * time.Hour), start.Add(3 * time.Hour)}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
+
+func TestWriteOpenMetricsSummary(t *testing.T) {
+	start := time.Unix(1724515200, 0)
+
+	m := NewMetrics()
+	m.Metric("len").Describe(Summary, "")
+	length := m.With("sender", "Alice").Metric("len").Quantiles(0.5, 0.9)
+	length.Observe(10, start)
+	length.Observe(20, start)
+
+	var b strings.Builder
+	if err := m.WriteOpenMetrics(&b, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	got := b.String()
+	want := "# TYPE len summary\n"
+	want += "len{quantile=\"0.5\",sender=\"Alice\"} 15 1724515200\n"
+	want += "len{quantile=\"0.9\",sender=\"Alice\"} 20 1724515200\n"
+	want += "len_count{sender=\"Alice\"} 2 1724515200\n"
+	want += "len_sum{sender=\"Alice\"} 30 1724515200\n"
+	want += "# EOF\n"
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
@@ -0,0 +1,121 @@
+package backfill
+
+import (
+	"cmp"
+	"math"
+	"slices"
+)
+
+// tdigest estimates quantiles of a stream of values in bounded memory.
+// Values are merged into centroids, which are smaller near the extremes, so
+// that high and low quantiles are more accurate than the median.
+//
+// See https://arxiv.org/abs/1902.04023
+type tdigest struct {
+	compression float64
+	centroids   []centroid // sorted by mean
+	buffer      []centroid // added, but not yet merged
+	count       float64
+	min, max    float64
+}
+
+// centroid is the mean of weight values.
+type centroid struct {
+	mean   float64
+	weight float64
+}
+
+// newTDigest returns a tdigest that keeps about compression centroids.
+func newTDigest(compression float64) *tdigest {
+	return &tdigest{compression: compression, min: math.Inf(1), max: math.Inf(-1)}
+}
+
+func (d *tdigest) add(value float64) {
+	d.buffer = append(d.buffer, centroid{value, 1})
+	d.count++
+	d.min = min(d.min, value)
+	d.max = max(d.max, value)
+	if len(d.buffer) >= int(5*d.compression) {
+		d.compress()
+	}
+}
+
+// merge adds the values added to other.
+func (d *tdigest) merge(other *tdigest) {
+	d.buffer = append(d.buffer, other.centroids...)
+	d.buffer = append(d.buffer, other.buffer...)
+	d.count += other.count
+	d.min = min(d.min, other.min)
+	d.max = max(d.max, other.max)
+	if len(d.buffer) >= int(5*d.compression) {
+		d.compress()
+	}
+}
+
+// clone returns a copy of d.
+func (d *tdigest) clone() *tdigest {
+	c := *d
+	c.centroids = slices.Clone(d.centroids)
+	c.buffer = slices.Clone(d.buffer)
+	return &c
+}
+
+// compress merges the buffered values into the centroids. Neighbouring
+// centroids are merged as long as the result is not heavier than the limit
+// for its quantile.
+func (d *tdigest) compress() {
+	if len(d.buffer) == 0 {
+		return
+	}
+	all := slices.Concat(d.centroids, d.buffer)
+	slices.SortFunc(all, func(a, b centroid) int {
+		return cmp.Compare(a.mean, b.mean)
+	})
+	d.buffer = d.buffer[:0]
+
+	merged := all[:1]
+	var before float64 // weight of the centroids before the last one
+	for _, c := range all[1:] {
+		last := &merged[len(merged)-1]
+		weight := last.weight + c.weight
+		q := (before + weight/2) / d.count
+		if weight <= max(4*d.count*q*(1-q)/d.compression, 1) {
+			last.mean += (c.mean - last.mean) * c.weight / weight
+			last.weight = weight
+			continue
+		}
+		before += last.weight
+		merged = append(merged, c)
+	}
+	d.centroids = merged
+}
+
+// quantile returns the estimated q-quantile of the added values, or NaN if
+// no values were added. The estimate interpolates between the centers of the
+// centroids and the minimum and maximum value.
+func (d *tdigest) quantile(q float64) float64 {
+	d.compress()
+	if len(d.centroids) == 0 {
+		return math.NaN()
+	}
+	target := q * d.count
+	prevMean, prevCenter := d.min, 0.0
+	var cum float64
+	for _, c := range d.centroids {
+		center := cum + c.weight/2
+		if target < center {
+			return interpolate(prevMean, c.mean, (target-prevCenter)/(center-prevCenter))
+		}
+		prevMean, prevCenter = c.mean, center
+		cum += c.weight
+	}
+	if d.count == prevCenter {
+		return d.max
+	}
+	return interpolate(prevMean, d.max, (target-prevCenter)/(d.count-prevCenter))
+}
+
+// interpolate returns the value between a and b at fraction f.
+func interpolate(a, b, f float64) float64 {
+	return a + (b-a)*f
+}
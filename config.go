@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Config holds the settings of the config file. Fields correspond to the flags
+// of the same name and are nil if the file does not set them.
+type Config struct {
+	ChatExportsGlob   *string         `json:"chat-exports-glob"`
+	AliasesFile       *listFlag       `json:"aliases-file"`
+	ChatTypes         *listFlag       `json:"chat-types"`
+	ExcludeSenders    *listFlag       `json:"exclude-senders"`
+	AliasPatternsFile *string         `json:"alias-patterns-file"`
+	ExpressionsFile   *string         `json:"expressions-file"`
+	Output            *string         `json:"output"`
+	VMURL             *string         `json:"vm-url"`
+	RemoteWriteURL    *string         `json:"remote-write-url"`
+	InfluxURL         *string         `json:"influx-url"`
+	InfluxMeasurement *string         `json:"influx-measurement"`
+	GraphiteAddress   *string         `json:"graphite-address"`
+	DryRun            *bool           `json:"dry-run"`
+	Estimate          *bool           `json:"estimate"`
+	OutputFile        *string         `json:"output-file"`
+	Replace           *bool           `json:"replace"`
+	NoPreflight       *bool           `json:"no-preflight"`
+	UploadRetries     *int            `json:"upload-retries"`
+	UploadTimeout     *configDuration `json:"upload-timeout"`
+	Concurrency       *int            `json:"concurrency"`
+	SkipErrors        *bool           `json:"skip-errors"`
+	Resolution        *configDuration `json:"resolution"`
+	MetricsPrefix     *string         `json:"metrics-prefix"`
+	Timezone          *string         `json:"timezone"`
+	Align             *bool           `json:"align"`
+	NoFileLabel       *bool           `json:"no-file-label"`
+	MaxSpan           *configDuration `json:"max-span"`
+	SkipUnchanged     *bool           `json:"skip-unchanged"`
+	Dedup             *bool           `json:"dedup"`
+	LimitMessages     *int            `json:"limit-messages"`
+	AppendTimestamp   *bool           `json:"append-timestamp-label"`
+	RunID             *string         `json:"run-id"`
+	MaxCardinality    *int            `json:"max-cardinality"`
+	IncludeAnonymous  *bool           `json:"include-anonymous"`
+	Senderless        *bool           `json:"attribute-senderless"`
+	NormalizeSenders  *bool           `json:"normalize-senders"`
+	CollapseSpace     *bool           `json:"collapse-sender-whitespace"`
+	Verbose           *bool           `json:"verbose"`
+	Since             *timeFlag       `json:"since"`
+	Until             *timeFlag       `json:"until"`
+
+	MessageLengthBuckets   *bucketsFlag `json:"message-length-buckets"`
+	MessageLengthQuantiles *bucketsFlag `json:"message-length-quantiles"`
+	SenderGapBuckets       *bucketsFlag `json:"sender-gap-buckets"`
+	ReplyLatencyBuckets    *bucketsFlag `json:"reply-latency-buckets"`
+
+	// VictoriaMetrics connection and authentication. Environment variables
+	// of the same name, e.g. VICTORIAMETRICS_URL, take precedence.
+	VictoriaMetricsURL      *string `json:"victoriametrics-url"`
+	VictoriaMetricsUser     *string `json:"victoriametrics-user"`
+	VictoriaMetricsPassword *string `json:"victoriametrics-password"`
+	VictoriaMetricsToken    *string `json:"victoriametrics-token"`
+}
+
+func loadConfigFile(path string) (*Config, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.DisallowUnknownFields() // catch typos
+	var c Config
+	if err := dec.Decode(&c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// apply sets the flags and environment variables the config sets, except for
+// the flags in explicit, which were given on the command line.
+func (c *Config) apply(explicit map[string]bool) {
+	override(explicit, "chat-exports-glob", chatExportsGlob, c.ChatExportsGlob)
+	override(explicit, "aliases-file", &aliasesFilesFlag, c.AliasesFile)
+	override(explicit, "chat-types", &chatTypesFlag, c.ChatTypes)
+	override(explicit, "exclude-senders", &excludeSendersFlag, c.ExcludeSenders)
+	override(explicit, "alias-patterns-file", aliasPatternsFileFlag, c.AliasPatternsFile)
+	override(explicit, "expressions-file", expressionsFileFlag, c.ExpressionsFile)
+	override(explicit, "output", outputFlag, c.Output)
+	override(explicit, "vm-url", vmURLFlag, c.VMURL)
+	override(explicit, "remote-write-url", remoteWriteURLFlag, c.RemoteWriteURL)
+	override(explicit, "influx-url", influxURLFlag, c.InfluxURL)
+	override(explicit, "influx-measurement", influxMeasurementFlag, c.InfluxMeasurement)
+	override(explicit, "graphite-address", graphiteAddressFlag, c.GraphiteAddress)
+	override(explicit, "dry-run", dryRunFlag, c.DryRun)
+	override(explicit, "estimate", estimateFlag, c.Estimate)
+	override(explicit, "output-file", outputFileFlag, c.OutputFile)
+	override(explicit, "replace", replaceFlag, c.Replace)
+	override(explicit, "no-preflight", noPreflightFlag, c.NoPreflight)
+	override(explicit, "upload-retries", uploadRetriesFlag, c.UploadRetries)
+	override(explicit, "upload-timeout", (*configDuration)(uploadTimeoutFlag), c.UploadTimeout)
+	override(explicit, "concurrency", concurrencyFlag, c.Concurrency)
+	override(explicit, "skip-errors", skipErrorsFlag, c.SkipErrors)
+	override(explicit, "resolution", (*configDuration)(resolutionFlag), c.Resolution)
+	override(explicit, "metrics-prefix", metricsPrefixFlag, c.MetricsPrefix)
+	override(explicit, "timezone", timezoneFlag, c.Timezone)
+	override(explicit, "align", alignFlag, c.Align)
+	override(explicit, "no-file-label", noFileLabelFlag, c.NoFileLabel)
+	override(explicit, "max-span", (*configDuration)(maxSpanFlag), c.MaxSpan)
+	override(explicit, "skip-unchanged", skipUnchangedFlag, c.SkipUnchanged)
+	override(explicit, "dedup", dedupFlag, c.Dedup)
+	override(explicit, "limit-messages", limitMessagesFlag, c.LimitMessages)
+	override(explicit, "append-timestamp-label", appendTimestampFlag, c.AppendTimestamp)
+	override(explicit, "run-id", runIDFlag, c.RunID)
+	override(explicit, "max-cardinality", maxCardinalityFlag, c.MaxCardinality)
+	override(explicit, "include-anonymous", includeAnonymousFlag, c.IncludeAnonymous)
+	override(explicit, "attribute-senderless", senderlessFlag, c.Senderless)
+	override(explicit, "normalize-senders", normalizeSendersFlag, c.NormalizeSenders)
+	override(explicit, "collapse-sender-whitespace", collapseSpaceFlag, c.CollapseSpace)
+	override(explicit, "verbose", verboseFlag, c.Verbose)
+	override(explicit, "since", &sinceFlag, c.Since)
+	override(explicit, "until", &untilFlag, c.Until)
+	override(explicit, "message-length-buckets", &messageLengthBucketsFlag, c.MessageLengthBuckets)
+	override(explicit, "message-length-quantiles", &messageLengthQuantilesFlag, c.MessageLengthQuantiles)
+	override(explicit, "sender-gap-buckets", &senderGapBucketsFlag, c.SenderGapBuckets)
+	override(explicit, "reply-latency-buckets", &replyLatencyBucketsFlag, c.ReplyLatencyBuckets)
+
+	for env, value := range map[string]*string{
+		"VICTORIAMETRICS_URL":      c.VictoriaMetricsURL,
+		"VICTORIAMETRICS_USER":     c.VictoriaMetricsUser,
+		"VICTORIAMETRICS_PASSWORD": c.VictoriaMetricsPassword,
+		"VICTORIAMETRICS_TOKEN":    c.VictoriaMetricsToken,
+	} {
+		if os.Getenv(env) == "" && value != nil {
+			_ = os.Setenv(env, *value)
+		}
+	}
+}
+
+// override sets the flag with the given name to value, unless value is nil
+// or the flag is explicit.
+func override[T any](explicit map[string]bool, name string, dst, value *T) {
+	if value != nil && !explicit[name] {
+		*dst = *value
+	}
+}
+
+// configDuration is a time.Duration that is given as string like "1h" in the config file.
+type configDuration time.Duration
+
+func (d *configDuration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = configDuration(parsed)
+	return nil
+}
+
+// UnmarshalJSON accepts an array of strings or a single comma-separated string.
+func (f *listFlag) UnmarshalJSON(b []byte) error {
+	var list []string
+	if err := json.Unmarshal(b, &list); err == nil {
+		*f = list
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("want string or array of strings, got %s", b)
+	}
+	return f.Set(s)
+}
+
+// UnmarshalJSON accepts the same formats as Set.
+// Without it, the method of the embedded time.Time would only accept RFC 3339.
+func (f *timeFlag) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("want string, got %s", b)
+	}
+	return f.Set(s)
+}
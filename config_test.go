@@ -0,0 +1,115 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestConfigFile(t *testing.T) {
+	// Restore the flags changed by the test.
+	resolution, outputFile, since := *resolutionFlag, *outputFileFlag, sinceFlag
+	t.Cleanup(func() {
+		*resolutionFlag, *outputFileFlag, sinceFlag = resolution, outputFile, since
+	})
+	t.Setenv("VICTORIAMETRICS_TOKEN", "from-env")
+	t.Setenv("VICTORIAMETRICS_USER", "")
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(path, []byte(`{
+		"resolution": "24h",
+		"output-file": "metrics.txt",
+		"since": "2024-01-01",
+		"victoriametrics-user": "alice",
+		"victoriametrics-token": "from-config"
+	}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := loadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// -resolution=1m was given on the command line.
+	*resolutionFlag = time.Minute
+	config.apply(map[string]bool{"resolution": true})
+
+	if *resolutionFlag != time.Minute {
+		t.Errorf("resolution: got %s, want the flag to take precedence", *resolutionFlag)
+	}
+	if *outputFileFlag != "metrics.txt" {
+		t.Errorf("output-file: got %q, want %q", *outputFileFlag, "metrics.txt")
+	}
+	if want := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC); !sinceFlag.Equal(want) {
+		t.Errorf("since: got %s, want %s", sinceFlag.Time, want)
+	}
+	if got := os.Getenv("VICTORIAMETRICS_USER"); got != "alice" {
+		t.Errorf("VICTORIAMETRICS_USER: got %q, want %q", got, "alice")
+	}
+	if got := os.Getenv("VICTORIAMETRICS_TOKEN"); got != "from-env" {
+		t.Errorf("VICTORIAMETRICS_TOKEN: got %q, want the environment to take precedence", got)
+	}
+}
+
+func TestConfigFileVMURL(t *testing.T) {
+	vmURL := *vmURLFlag
+	t.Cleanup(func() { *vmURLFlag = vmURL })
+	t.Setenv("VICTORIAMETRICS_URL", "http://from-env:8428")
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"vm-url": "http://from-config:8428"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.apply(nil)
+	if got, want := victoriaMetricsURL(), "http://from-config:8428"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// -vm-url given on the command line takes precedence.
+	*vmURLFlag = "http://from-flag:8428"
+	config.apply(map[string]bool{"vm-url": true})
+	if got, want := victoriaMetricsURL(), "http://from-flag:8428"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestConfigFileAliasesFile(t *testing.T) {
+	aliasesFiles := aliasesFilesFlag
+	t.Cleanup(func() { aliasesFilesFlag = aliasesFiles })
+
+	for config, want := range map[string]listFlag{
+		`{"aliases-file": "a.json"}`:             {"a.json"},
+		`{"aliases-file": "a.json,b.json"}`:      {"a.json", "b.json"},
+		`{"aliases-file": ["a.json", "b.json"]}`: {"a.json", "b.json"},
+	} {
+		path := filepath.Join(t.TempDir(), "config.json")
+		if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		c, err := loadConfigFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.apply(nil)
+		if !slices.Equal(aliasesFilesFlag, want) {
+			t.Errorf("%s: got %q, want %q", config, aliasesFilesFlag, want)
+		}
+	}
+}
+
+func TestConfigFileUnknownField(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"resolutoin": "24h"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfigFile(path); err == nil {
+		t.Error("want error for unknown field")
+	}
+}
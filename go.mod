@@ -1,5 +1,7 @@
 module github.com/ngrash/tgstat
 
-go 1.23
+go 1.23.0
 
 require github.com/google/go-cmp v0.6.0
+
+require golang.org/x/text v0.24.0
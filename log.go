@@ -0,0 +1,26 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+)
+
+// logger logs the progress of a run. It writes to stderr, so that metrics
+// written to stdout with -dry-run are not mixed with log messages.
+// Debug messages are only logged with -verbose.
+var logger = newLogger(os.Stderr, slog.LevelInfo)
+
+// newLogger returns a logger that writes messages of at least level to w.
+func newLogger(w io.Writer, level slog.Level) *slog.Logger {
+	return slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			// Runs take seconds, so timestamps are noise.
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+}
@@ -1,187 +1,711 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
+	"cmp"
 	"compress/gzip"
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
-	"net/http"
+	"io"
+	"log/slog"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/ngrash/tgstat/analyze"
 	"github.com/ngrash/tgstat/backfill"
 	"github.com/ngrash/tgstat/tgexport"
 )
 
 var (
-	chatExportsGlob     = flag.String("chat-exports-glob", "chat-exports/*/result.json", "Glob pattern to find chat exports")
-	aliasesFileFlag     = flag.String("aliases-file", "configs/aliases.json", "File with sender aliases")
-	expressionsFileFlag = flag.String("expressions-file", "configs/expressions.json", "File with expressions to search for")
+	configFileFlag        = flag.String("config", "configs/config.json", "File with settings for any of the other flags. Flags given on the command line take precedence")
+	chatExportsGlob       = flag.String("chat-exports-glob", "chat-exports/*/result.json", "Glob pattern to find chat exports, or - to read a single export from stdin")
+	aliasPatternsFileFlag = flag.String("alias-patterns-file", "configs/alias-patterns.json", "File with sender aliases by regular expression, applied if no alias in -aliases-file matches")
+	expressionsFileFlag   = flag.String("expressions-file", "configs/expressions.json", "File with expressions to search for")
+	outputFlag            = flag.String("output", "victoriametrics", "Where to send metrics: victoriametrics (import API), remote-write (Prometheus remote write protocol), influx (InfluxDB line protocol), graphite (Graphite plaintext protocol), json or openmetrics (both written to stdout or -output-file)")
+	vmURLFlag             = flag.String("vm-url", "", "VictoriaMetrics URL used with -output=victoriametrics. Takes precedence over VICTORIAMETRICS_URL (default http://localhost:8428)")
+	remoteWriteURLFlag    = flag.String("remote-write-url", "", "Prometheus remote write endpoint used with -output=remote-write (default VictoriaMetrics' /api/v1/write)")
+	influxURLFlag         = flag.String("influx-url", "", "InfluxDB write endpoint used with -output=influx, including query parameters like db or bucket (default VictoriaMetrics' /write)")
+	influxMeasurementFlag = flag.String("influx-measurement", "tgstat", "Measurement name used with -output=influx")
+	graphiteAddressFlag   = flag.String("graphite-address", "localhost:2003", "TCP address of the Carbon plaintext receiver used with -output=graphite")
+	estimateFlag          = flag.Bool("estimate", false, "Log the number of samples and bytes of the metrics at -resolution, then exit without writing or uploading them")
+	dryRunFlag            = flag.Bool("dry-run", false, "Write metrics to stdout or -output-file instead of uploading them")
+	outputFileFlag        = flag.String("output-file", "", "File to write metrics to with -dry-run, -output=json or -output=openmetrics (default stdout). With -output=victoriametrics, the uploaded metrics are also written to the file")
+	noPreflightFlag       = flag.Bool("no-preflight", false, "Skip checking that VictoriaMetrics is reachable before the exports are analyzed")
+	replaceFlag           = flag.Bool("replace", false, "Delete existing metrics of the analyzed files before uploading. Without it, re-imported samples rely on VictoriaMetrics' deduplication, but series that are gone from the exports, e.g. after renaming a sender, remain")
+	uploadRetriesFlag     = flag.Int("upload-retries", 3, "How often to retry failed uploads")
+	uploadTimeoutFlag     = flag.Duration("upload-timeout", 5*time.Minute, "Timeout of a single upload attempt")
+	concurrencyFlag       = flag.Int("concurrency", runtime.NumCPU(), "Number of files to analyze in parallel")
+	resolutionFlag        = flag.Duration("resolution", 1*time.Hour, "Time between samples. Smaller resolutions produce more samples and larger uploads")
+	skipErrorsFlag        = flag.Bool("skip-errors", false, "Skip files that cannot be analyzed instead of aborting. Messages read before the error are still counted")
+	metricsPrefixFlag     = flag.String("metrics-prefix", analyze.MetricsPrefix, "Prefix of all metric names, e.g. to share a database with other users")
+	timezoneFlag          = flag.String("timezone", "UTC", "IANA time zone, e.g. Europe/Berlin, of dates in exports without Unix timestamps. Also determines the hour and weekday of messages")
+	maxSpanFlag           = flag.Duration("max-span", 0, "Only write samples of the given span before the last message, e.g. 8760h for a year. Older messages still count towards totals. 0 writes all samples")
+	noFileLabelFlag       = flag.Bool("no-file-label", false, "Do not label metrics with their file, so that series of the same chat and sender in different files, e.g. exports split by sender, merge into one")
+	alignFlag             = flag.Bool("align", false, "Align samples to multiples of the resolution, e.g. the full hour, instead of the first message")
+	verboseFlag           = flag.Bool("verbose", false, "Log debug messages, e.g. every analyzed file and upload attempt")
+	includeAnonymousFlag  = flag.Bool("include-anonymous", false, "Count messages without sender, e.g. of anonymous admins, as sent by <anonymous> instead of skipping them")
+	normalizeSendersFlag  = flag.Bool("normalize-senders", false, "Convert senders to Unicode NFC and trim them after applying aliases, so that e.g. \"Bob \" and \"Bob\" are one sender")
+	collapseSpaceFlag     = flag.Bool("collapse-sender-whitespace", false, "With -normalize-senders, also collapse runs of whitespace within senders into a single space")
+	senderlessFlag        = flag.Bool("attribute-senderless", false, "Count channel posts without sender as sent by the channel and Saved Messages as sent by the exporting account")
+	appendTimestampFlag   = flag.Bool("append-timestamp-label", false, "Label all metrics with run, the start time of the run, to tell apart the series of different runs")
+	runIDFlag             = flag.String("run-id", "", "Label all metrics with run set to this value instead of the start time, e.g. a commit hash of the configs")
+	limitMessagesFlag     = flag.Int("limit-messages", 0, "Only analyze the first N messages of each file, e.g. to try settings quickly on large exports. The metrics are a sample, not the full picture (default 0, unlimited)")
+	dedupFlag             = flag.Bool("dedup", false, "Count messages with the same ID in the same chat once, e.g. of exports with overlapping time ranges")
+	maxCardinalityFlag    = flag.Int("max-cardinality", 0, "Maximum number of series per metric. Values of further series, e.g. of rare hashtags, are counted in a series labeled __other__ (default 0, unlimited)")
+	skipUnchangedFlag     = flag.Bool("skip-unchanged", false, "Omit samples with the same value as the previous sample of their series, except for the last one. Not suited for Prometheus, which considers such series stale")
+
+	sinceFlag, untilFlag timeFlag
+
+	aliasesFilesFlag           = listFlag{"configs/aliases.json"}
+	chatTypesFlag              listFlag
+	excludeSendersFlag         listFlag
+	messageLengthBucketsFlag   = bucketsFlag{10, 25, 50, 100, 250, 500, 1000}
+	messageLengthQuantilesFlag bucketsFlag
+	senderGapBucketsFlag       = bucketsFlag{60, 300, 900, 3600, 21600, 86400, 604800}
+	replyLatencyBucketsFlag    = bucketsFlag{60, 300, 900, 3600, 21600, 86400}
 )
 
+func init() {
+	flag.Var(&aliasesFilesFlag, "aliases-file", "Comma-separated files with sender aliases. Later files override aliases of earlier files")
+	flag.Var(&excludeSendersFlag, "exclude-senders", "Comma-separated senders to leave out of all metrics, e.g. bots. Aliases are applied first")
+	flag.Var(&chatTypesFlag, "chat-types", "Comma-separated chat types to analyze, e.g. private_group,public_supergroup (default all)")
+	flag.Var(&messageLengthBucketsFlag, "message-length-buckets", "Comma-separated upper bounds of the tg_message_length histogram buckets, in runes")
+	flag.Var(&messageLengthQuantilesFlag, "message-length-quantiles", "Comma-separated quantiles of the tg_message_length_summary summary, e.g. 0.5,0.9,0.99 (default none)")
+	flag.Var(&senderGapBucketsFlag, "sender-gap-buckets", "Comma-separated upper bounds of the tg_sender_gap_seconds histogram buckets, in seconds")
+	flag.Var(&replyLatencyBucketsFlag, "reply-latency-buckets", "Comma-separated upper bounds of the tg_reply_latency_seconds histogram buckets, in seconds")
+	flag.Var(&sinceFlag, "since", "Only analyze messages sent at or after this RFC 3339 timestamp or date (YYYY-MM-DD)")
+	flag.Var(&untilFlag, "until", "Only analyze messages sent before this RFC 3339 timestamp or date (YYYY-MM-DD)")
+}
+
+// timeFlag is a flag.Value for a point in time given as RFC 3339 timestamp or date.
+type timeFlag struct {
+	time.Time
+}
+
+func (f *timeFlag) String() string {
+	if f.IsZero() {
+		return ""
+	}
+	return f.Format(time.RFC3339)
+}
+
+func (f *timeFlag) Set(s string) error {
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		if t, err := time.Parse(layout, s); err == nil {
+			f.Time = t
+			return nil
+		}
+	}
+	return fmt.Errorf("want RFC 3339 timestamp or date (YYYY-MM-DD), got %q", s)
+}
+
+// listFlag is a flag.Value for a comma-separated list of strings.
+type listFlag []string
+
+func (f *listFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *listFlag) Set(s string) error {
+	*f = strings.Split(s, ",")
+	return nil
+}
+
+// bucketsFlag is a flag.Value for comma-separated numbers, e.g. histogram
+// bucket bounds or quantiles.
+type bucketsFlag []float64
+
+func (f *bucketsFlag) String() string {
+	s := make([]string, len(*f))
+	for i, b := range *f {
+		s[i] = strconv.FormatFloat(b, 'f', -1, 64)
+	}
+	return strings.Join(s, ",")
+}
+
+func (f *bucketsFlag) Set(s string) error {
+	var buckets bucketsFlag
+	for _, b := range strings.Split(s, ",") {
+		bound, err := strconv.ParseFloat(strings.TrimSpace(b), 64)
+		if err != nil {
+			return err
+		}
+		buckets = append(buckets, bound)
+	}
+	*f = buckets
+	return nil
+}
+
+// metricsPrefixPattern matches valid prefixes of Prometheus metric names.
+var metricsPrefixPattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
 func main() {
-	if err := run(); err != nil {
+	// Cancel on Ctrl-C, so that uploads are not interrupted halfway.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx); err != nil {
 		_, _ = fmt.Fprint(os.Stderr, err)
 		os.Exit(1)
 	}
 }
 
-func run() error {
+func run(ctx context.Context) error {
 	flag.Parse()
 
-	files, err := filepath.Glob(*chatExportsGlob)
+	config, err := loadConfigFile(*configFileFlag)
 	if err != nil {
-		return fmt.Errorf("find files: %w", err)
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("load config: %w", err)
+		}
+	} else {
+		explicit := map[string]bool{}
+		flag.Visit(func(f *flag.Flag) {
+			explicit[f.Name] = true
+		})
+		config.apply(explicit)
+	}
+	if *verboseFlag {
+		logger = newLogger(os.Stderr, slog.LevelDebug)
 	}
 
-	metrics, err := readAndAnalyzeChatExports(files)
+	if !slices.Contains([]string{"victoriametrics", "remote-write", "influx", "graphite", "json", "openmetrics"}, *outputFlag) {
+		return fmt.Errorf("unknown output %q", *outputFlag)
+	}
+	if *outputFileFlag != "" && !*dryRunFlag && !slices.Contains([]string{"victoriametrics", "json", "openmetrics"}, *outputFlag) {
+		return fmt.Errorf("output file is not supported with output %q, unless with -dry-run", *outputFlag)
+	}
+	if *concurrencyFlag < 1 {
+		return fmt.Errorf("concurrency must be at least 1, got %d", *concurrencyFlag)
+	}
+	if *limitMessagesFlag < 0 {
+		return fmt.Errorf("limit messages must not be negative, got %d", *limitMessagesFlag)
+	}
+	if *limitMessagesFlag > 0 {
+		logger.Warn("Only analyzing the first messages of each file. The metrics are a sample.", "limit", *limitMessagesFlag)
+	}
+	if *resolutionFlag <= 0 {
+		return fmt.Errorf("resolution must be positive, got %s", *resolutionFlag)
+	}
+	if !metricsPrefixPattern.MatchString(*metricsPrefixFlag) {
+		return fmt.Errorf("metrics prefix must match %s, got %q", metricsPrefixPattern, *metricsPrefixFlag)
+	}
+	for _, q := range messageLengthQuantilesFlag {
+		if q < 0 || q > 1 {
+			return fmt.Errorf("message length quantiles must be between 0 and 1, got %v", q)
+		}
+	}
+	location, err := time.LoadLocation(*timezoneFlag)
+	if err != nil {
+		return fmt.Errorf("load timezone: %w", err)
+	}
+	tgexport.Location = location
+	if u, err := url.Parse(victoriaMetricsURL()); err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("VictoriaMetrics URL must be an absolute URL like http://localhost:8428, got %q", victoriaMetricsURL())
+	}
+	if !sinceFlag.IsZero() && !untilFlag.IsZero() && !sinceFlag.Before(untilFlag.Time) {
+		return fmt.Errorf("since (%s) must be before until (%s)", &sinceFlag, &untilFlag)
+	}
+	// VictoriaMetrics deletes matching series in full, not just a time window,
+	// so the data outside the window would be lost.
+	if *replaceFlag && (!sinceFlag.IsZero() || !untilFlag.IsZero()) {
+		return fmt.Errorf("replace is not supported with since or until, as it deletes the series outside the time window as well")
+	}
+
+	files := []string{stdinFile}
+	if *chatExportsGlob != stdinFile {
+		files, err = filepath.Glob(*chatExportsGlob)
+		if err != nil {
+			return fmt.Errorf("find files: %w", err)
+		}
+	}
+
+	// Fail before the analysis, which takes a while for large exports.
+	if *outputFlag == "victoriametrics" && !*dryRunFlag && !*estimateFlag && !*noPreflightFlag {
+		if err := checkVictoriaMetrics(ctx, victoriaMetricsURL()); err != nil {
+			return fmt.Errorf("VictoriaMetrics at %s is not available, use -no-preflight to skip this check: %w", victoriaMetricsURL(), err)
+		}
+	}
+
+	result, err := readAndAnalyzeChatExports(ctx, files)
 	if err != nil {
 		return fmt.Errorf("analyze chat exports: %w", err)
 	}
+	if *skipErrorsFlag {
+		logger.Info("Analyzed files", "analyzed", len(result.succeeded), "total", len(result.succeeded)+len(result.failed))
+		for _, file := range result.succeeded {
+			logger.Info("Analyzed file", "file", file)
+		}
+		for _, f := range result.failed {
+			logger.Warn("Skipped file", "file", f.file, "err", f.err)
+		}
+	}
+	metrics := result.metrics
+	if s := result.summary; s.Messages > 0 {
+		logger.Info("Analyzed messages", "messages", s.Messages, "senders", s.Senders,
+			"first", s.First.Format(time.DateTime), "last", s.Last.Format(time.DateTime), "series", result.series)
+	}
+
+	var writeOpts []backfill.WriteOption
+	if *alignFlag {
+		writeOpts = append(writeOpts, backfill.AlignToResolution())
+	}
+	if *skipUnchangedFlag {
+		writeOpts = append(writeOpts, backfill.SkipUnchanged())
+	}
+	if *maxSpanFlag > 0 {
+		writeOpts = append(writeOpts, backfill.MaxSpan(*maxSpanFlag))
+		if s := result.summary; s.Last.Sub(s.First) > *maxSpanFlag {
+			logger.Warn("Messages exceed -max-span, older samples are not written",
+				"first", s.First.Format(time.DateTime), "start", s.Last.Add(-*maxSpanFlag).Format(time.DateTime))
+		}
+	}
+
+	if *estimateFlag {
+		samples, bytes, err := metrics.Size(*resolutionFlag, writeOpts...)
+		if err != nil {
+			return fmt.Errorf("estimate metrics: %w", err)
+		}
+		logger.Info("Estimated metrics", "samples", samples, "bytes", bytes, "resolution", *resolutionFlag)
+		return nil
+	}
+
+	if *dryRunFlag || *outputFlag == "json" || *outputFlag == "openmetrics" {
+		size, err := writeMetrics(metrics, *outputFileFlag, *outputFlag, *resolutionFlag, writeOpts...)
+		if err != nil {
+			return fmt.Errorf("write metrics: %w", err)
+		}
+		logger.Info("Done", "bytes", size)
+		return nil
+	}
 
-	fmt.Println("Uploading to VictoriaMetrics")
-	if err := uploadToVictoriaMetrics(metrics); err != nil {
-		return fmt.Errorf("upload to VictoriaMetrics: %w", err)
+	if os.Getenv("VICTORIAMETRICS_TOKEN") != "" && os.Getenv("VICTORIAMETRICS_USER") != "" {
+		logger.Warn("VICTORIAMETRICS_TOKEN and VICTORIAMETRICS_USER are both set. Using the token.")
 	}
 
-	fmt.Println("Done")
+	// size is the number of bytes uploaded, compressed if the upload is.
+	var size int64
+	switch *outputFlag {
+	case "victoriametrics":
+		vmURL := victoriaMetricsURL()
+		logger.Info("Uploading to VictoriaMetrics", "url", vmURL)
+		var replace []replaceScope
+		if *replaceFlag {
+			// Existing metrics of skipped files are kept, as they might be more complete.
+			replace = replaceScopes(result.succeeded, result.chats)
+		}
+		if *outputFileFlag != "" {
+			// The file is uploaded as written, so that it is the same as the upload.
+			written, err := writeMetrics(metrics, *outputFileFlag, *outputFlag, *resolutionFlag, writeOpts...)
+			if err != nil {
+				return fmt.Errorf("write metrics: %w", err)
+			}
+			logger.Info("Wrote metrics", "file", *outputFileFlag, "bytes", written)
+			if size, err = uploadFileToVictoriaMetrics(ctx, *outputFileFlag, vmURL, replace); err != nil {
+				return fmt.Errorf("upload to VictoriaMetrics: %w", err)
+			}
+		} else if size, err = uploadToVictoriaMetrics(ctx, metrics, vmURL, *resolutionFlag, replace, writeOpts...); err != nil {
+			return fmt.Errorf("upload to VictoriaMetrics: %w", err)
+		}
+	case "remote-write":
+		logger.Info("Sending remote write", "url", remoteWriteURL())
+		if size, err = sendRemoteWrite(ctx, metrics, *resolutionFlag, writeOpts...); err != nil {
+			return fmt.Errorf("send remote write: %w", err)
+		}
+	case "influx":
+		logger.Info("Sending to InfluxDB", "url", influxURL())
+		if size, err = sendInflux(ctx, metrics, *influxMeasurementFlag, *resolutionFlag, writeOpts...); err != nil {
+			return fmt.Errorf("send to InfluxDB: %w", err)
+		}
+	case "graphite":
+		logger.Info("Sending to Graphite", "address", *graphiteAddressFlag)
+		if size, err = sendGraphite(ctx, metrics, *graphiteAddressFlag, *resolutionFlag, writeOpts...); err != nil {
+			return fmt.Errorf("send to Graphite: %w", err)
+		}
+	}
+
+	logger.Info("Done", "bytes", size)
 
 	return nil
 }
 
-func readAndAnalyzeChatExports(files []string) (*backfill.Metrics, error) {
-	aliases, err := loadAliasFile(*aliasesFileFlag)
+// analysisResult is the outcome of readAndAnalyzeChatExports.
+type analysisResult struct {
+	metrics *backfill.Metrics
+
+	// succeeded and failed list the analyzed files in the order they were given.
+	// Files only fail with -skip-errors, otherwise the first error is returned.
+	succeeded []string
+	failed    []fileError
+
+	// summary counts the analyzed messages and series counts the recorded series.
+	summary analyze.Summary
+	series  int
+
+	// chats are the names of the analyzed chats, sorted.
+	chats []string
+}
+
+// progressInterval is the time between progress reports during the analysis.
+var progressInterval = 5 * time.Second
+
+// reportProgress logs the number of analyzed messages and recorded series
+// every progressInterval until done is closed.
+func reportProgress(stats []analyze.Stats, metrics *backfill.Metrics, done <-chan struct{}) {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			var messages int
+			for i := range stats {
+				messages += stats[i].Summary().Messages
+			}
+			logger.Info("Analyzing", "messages", messages, "series", metrics.Len())
+		case <-done:
+			return
+		}
+	}
+}
+
+// fileError is the error that occurred while analyzing a file.
+type fileError struct {
+	file string
+	err  error
+}
+
+func readAndAnalyzeChatExports(ctx context.Context, files []string) (*analysisResult, error) {
+	aliases, missing, err := analyze.LoadAliasFiles(aliasesFilesFlag)
+	if err != nil {
+		return nil, fmt.Errorf("load aliases: %w", err)
+	}
+	for _, file := range missing {
+		logger.Warn("Alias file not found. Will not replace sender names of this file.", "file", file)
+	}
+
+	aliasPatterns, err := analyze.LoadAliasPatterns(*aliasPatternsFileFlag)
 	if err != nil {
 		if os.IsNotExist(err) {
-			fmt.Printf("%q: Alias file not found. Will not replace sender names.\n", *aliasesFileFlag)
+			logger.Warn("Alias patterns file not found. Will not replace sender names by pattern.", "file", *aliasPatternsFileFlag)
 		} else {
-			return nil, fmt.Errorf("load aliases: %w", err)
+			return nil, fmt.Errorf("load alias patterns: %w", err)
 		}
 	}
 
-	expressions, err := loadExpressionsFile(*expressionsFileFlag)
+	expressions, err := analyze.LoadExpressions(*expressionsFileFlag)
 	if err != nil {
 		if os.IsNotExist(err) {
-			fmt.Printf("%q: Expressions file not found. Will not search for expressions.\n", *expressionsFileFlag)
+			logger.Warn("Expressions file not found. Will not search for expressions.", "file", *expressionsFileFlag)
 		} else {
 			return nil, fmt.Errorf("load expressions: %w", err)
 		}
 	}
 
-	metrics := backfill.NewMetrics()
-	for _, in := range files {
-		fmt.Println("Analyzing", in)
-		data, err := tgexport.ReadFile(in)
-		if err != nil {
-			return nil, fmt.Errorf("read file: %w", err)
-		}
+	opts := analyze.Options{
+		Expressions:            expressions,
+		Aliases:                aliases,
+		AliasPatterns:          aliasPatterns,
+		ExcludeSenders:         senders(excludeSendersFlag),
+		MessageLengthBuckets:   messageLengthBucketsFlag,
+		MessageLengthQuantiles: messageLengthQuantilesFlag,
+		SenderGapBuckets:       senderGapBucketsFlag,
+		ReplyLatencyBuckets:    replyLatencyBucketsFlag,
+		MetricsPrefix:          *metricsPrefixFlag,
+		ChatTypes:              chatTypesFlag,
+		Since:                  sinceFlag.Time,
+		Until:                  untilFlag.Time,
+		IncludeAnonymous:       *includeAnonymousFlag,
+		AttributeSenderless:    *senderlessFlag,
+		NormalizeSenders:       *normalizeSendersFlag,
+		CollapseWhitespace:     *collapseSpaceFlag,
+		LimitMessages:          *limitMessagesFlag,
+		Stats:                  &analyze.Stats{},
+	}
+	if *dedupFlag {
+		opts.Dedup = &analyze.Dedup{}
+	}
+	metrics := newMetrics()
 
-		applySenderAliases(data, aliases)
+	exports := groupParts(files)
+	// Stats of each export, merged into opts.Stats on success like its metrics.
+	// Progress is reported across all of them.
+	exportStats := make([]analyze.Stats, len(exports))
+	done := make(chan struct{})
+	defer close(done)
+	go reportProgress(exportStats, metrics, done)
 
-		chatMetrics := metrics.With("file", in)
+	// Analyze exports in parallel. Each export is analyzed into its own
+	// Metrics, which are merged only on success, so that the partial metrics
+	// of skipped exports are not written. Likewise, the messages a skipped
+	// export added to the Dedup are forgotten, so that later exports count
+	// them. Errors are collected by the index of the export.
+	jobs := make(chan int)
+	errs := make([]error, len(exports))
+	var wg sync.WaitGroup
+	for range *concurrencyFlag {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				exportMetrics := newMetrics()
+				exportOpts := opts
+				exportOpts.Stats = &exportStats[i]
+				if opts.Dedup != nil {
+					exportOpts.Dedup = opts.Dedup.Export()
+				}
+				errs[i] = analyzeFile(ctx, exports[i], exportMetrics, exportOpts)
+				if errs[i] == nil {
+					errs[i] = metrics.Merge(exportMetrics)
+				}
+				if errs[i] == nil {
+					opts.Stats.Merge(&exportStats[i])
+				} else if exportOpts.Dedup != nil {
+					exportOpts.Dedup.Forget()
+				}
+			}
+		}()
+	}
+	for i := range exports {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	for _, name := range metrics.Overflowed() {
+		logger.Warn("Metric exceeded -max-cardinality. Further series are counted as "+backfill.OverflowLabelValue, "metric", name, "max", *maxCardinalityFlag)
+	}
 
-		if err := analyzeChat(data, chatMetrics, expressions); err != nil {
-			return nil, fmt.Errorf("analyze %q: %w", in, err)
+	result := &analysisResult{
+		metrics: metrics,
+		summary: opts.Stats.Summary(),
+		chats:   opts.Stats.Chats(),
+		series:  metrics.Len(),
+	}
+	for i, err := range errs {
+		if err == nil {
+			result.succeeded = append(result.succeeded, exports[i][0])
+			continue
+		}
+		// Canceled runs are aborted, even if errors are skipped.
+		if !*skipErrorsFlag || ctx.Err() != nil {
+			return nil, err
 		}
+		result.failed = append(result.failed, fileError{exports[i][0], err})
 	}
-	return metrics, nil
+	return result, nil
 }
 
-func loadExpressionsFile(path string) ([]*regexp.Regexp, error) {
-	buf, err := os.ReadFile(path)
-	if err != nil {
-		return nil, err
+// newMetrics returns empty Metrics configured by the flags.
+func newMetrics() *backfill.Metrics {
+	metrics := backfill.NewMetrics(backfill.SummaryResolution(*resolutionFlag))
+	metrics.LimitCardinality(*maxCardinalityFlag)
+	if run := runLabel(); run != "" {
+		metrics = metrics.With("run", run)
 	}
+	return metrics
+}
+
+// startTime is the time the run started. It is the default of the run label.
+var startTime = time.Now()
 
-	var exprs []string
-	if err := json.Unmarshal(buf, &exprs); err != nil {
-		return nil, err
+// runLabel returns the value of the run label, or an empty string if
+// metrics are not labeled with the run.
+func runLabel() string {
+	if *runIDFlag != "" {
+		return *runIDFlag
+	}
+	if *appendTimestampFlag {
+		return startTime.UTC().Format(time.RFC3339)
 	}
+	return ""
+}
+
+// stdinFile is the name of the export read from stdin. It is given as
+// -chat-exports-glob and used as file label.
+const stdinFile = "-"
 
-	var compiled []*regexp.Regexp
-	for _, expr := range exprs {
-		r, err := regexp.Compile(expr)
+// stdin is read for the export named stdinFile. Tests replace it.
+var stdin io.Reader = os.Stdin
+
+// analyzeFile analyzes the export in the files parts, see groupParts.
+// The file label and chat name are those of the first part.
+func analyzeFile(ctx context.Context, parts []string, metrics *backfill.Metrics, opts analyze.Options) error {
+	in := parts[0]
+	logger.Debug("Analyzing file", "file", in)
+	fileMetrics := metrics
+	if !*noFileLabelFlag {
+		fileMetrics = metrics.With("file", in)
+	}
+	opts.ChatName = chatName(in)
+	var err error
+	switch {
+	case in == stdinFile:
+		err = analyze.AnalyzeReader(ctx, stdin, fileMetrics, opts)
+	case len(parts) > 1:
+		// Parts may overlap, so they are read in full to skip duplicates.
+		var data *tgexport.Result
+		data, err = tgexport.ReadParts(parts)
 		if err != nil {
-			return nil, err
+			break
+		}
+		if data.Name != "" {
+			opts.ChatName = data.Name
 		}
-		compiled = append(compiled, r)
+		opts.ChatType = data.Type
+		err = analyze.Analyze(ctx, data, fileMetrics, opts)
+	default:
+		err = analyze.AnalyzeFile(ctx, in, fileMetrics, opts)
 	}
-	return compiled, nil
+	if err != nil {
+		return fmt.Errorf("analyze %q: %w", in, err)
+	}
+	return nil
 }
 
-type aliasMap map[tgexport.Sender]tgexport.Sender
+// partPattern matches the files of exports that Telegram split into parts,
+// e.g. result.json and result2.json, and captures the number of the part.
+var partPattern = regexp.MustCompile(`^result(\d*)\.json(\.gz)?$`)
 
-func loadAliasFile(path string) (aliasMap, error) {
-	buf, err := os.ReadFile(path)
-	if err != nil {
-		return nil, err
+// groupParts groups files into exports. The files matching partPattern in
+// the same directory are parts of one export, ordered by their number, and
+// other files are exports of their own. Exports are in the order of their
+// first file in files.
+func groupParts(files []string) [][]string {
+	var exports [][]string
+	byDir := map[string]int{}
+	for _, file := range files {
+		if !partPattern.MatchString(filepath.Base(file)) {
+			exports = append(exports, []string{file})
+			continue
+		}
+		dir := filepath.Dir(file)
+		i, ok := byDir[dir]
+		if !ok {
+			i = len(exports)
+			byDir[dir] = i
+			exports = append(exports, nil)
+		}
+		exports[i] = append(exports[i], file)
 	}
-	var a aliasMap
-	if err := json.Unmarshal(buf, &a); err != nil {
-		return nil, err
+	for _, parts := range exports {
+		slices.SortStableFunc(parts, func(a, b string) int {
+			return cmp.Compare(partNumber(a), partNumber(b))
+		})
 	}
-	return a, nil
+	return exports
 }
 
-func applySenderAliases(data *tgexport.Result, aliases aliasMap) {
-	for i, m := range data.Messages {
-		if alias, replace := aliases[m.From]; replace {
-			data.Messages[i].From = alias
-		}
+// partNumber returns the number of the part in file, which matches
+// partPattern. The first part, result.json, has no number.
+func partNumber(file string) int {
+	m := partPattern.FindStringSubmatch(filepath.Base(file))
+	n, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 1
 	}
+	return n
 }
 
-func victoriaMetricsURL() string {
-	if url := os.Getenv("VICTORIAMETRICS_URL"); url != "" {
-		return url
+// senders converts names to senders.
+func senders(names []string) []tgexport.Sender {
+	s := make([]tgexport.Sender, len(names))
+	for i, name := range names {
+		s[i] = tgexport.Sender(name)
 	}
-	return "http://localhost:8428"
+	return s
 }
 
-func uploadToVictoriaMetrics(metrics *backfill.Metrics) error {
-	var compressed bytes.Buffer
+// chatName derives the name of a chat from the path of its export.
+// It is used for exports without chat name. Exports are usually named
+// result.json, so the name of the directory is used in that case.
+func chatName(path string) string {
+	name := filepath.Base(path)
+	name = strings.TrimSuffix(name, ".gz")
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	if name == "result" {
+		return filepath.Base(filepath.Dir(path))
+	}
+	return name
+}
 
-	// Compress the metrics.
-	w := gzip.NewWriter(&compressed)
-	if err := metrics.Write(w, 1*time.Hour); err != nil {
-		return fmt.Errorf("write metrics: %w", err)
+// writeMetrics writes the uncompressed metrics to the file at path,
+// or to stdout if path is empty. Metrics are written in the format of the
+// output, e.g. as JSON for the json output or in the InfluxDB line protocol
+// for the influx output, and in the Prometheus text format for the
+// victoriametrics output. It returns the number of bytes written, which are
+// compressed for files ending in .gz.
+func writeMetrics(metrics *backfill.Metrics, path, output string, resolution time.Duration, opts ...backfill.WriteOption) (int64, error) {
+	var size atomic.Int64
+	var out io.Writer = os.Stdout
+	var f *os.File
+	if path != "" {
+		var err error
+		if f, err = os.Create(path); err != nil {
+			return 0, err
+		}
+		// Closed explicitly on success, as errors of the last write may only
+		// be reported by Close.
+		defer f.Close()
+		out = f
 	}
-	// Flushing is important, otherwise the compressed data might not be complete.
-	if err := w.Flush(); err != nil {
-		return fmt.Errorf("flush gzip writer: %w", err)
+	out = &countingWriter{w: out, n: &size}
+	var gz *gzip.Writer
+	if isGzipFile(path) {
+		gz = gzip.NewWriter(out)
+		out = gz
 	}
 
-	// Delete the existing metrics.
-	if err := deleteRemoteMetrics(); err != nil {
-		return fmt.Errorf("delete remote metrics: %w", err)
+	w := bufio.NewWriter(out)
+	write := metrics.Write
+	switch output {
+	case "json":
+		write = metrics.WriteJSON
+	case "openmetrics":
+		write = metrics.WriteOpenMetrics
+	case "remote-write":
+		write = metrics.WriteRemoteWrite
+	case "influx":
+		write = func(w io.Writer, resolution time.Duration, opts ...backfill.WriteOption) error {
+			return metrics.WriteInflux(w, *influxMeasurementFlag, resolution, opts...)
+		}
+	case "graphite":
+		write = func(w io.Writer, resolution time.Duration, opts ...backfill.WriteOption) error {
+			return metrics.WriteGraphite(w, *metricsPrefixFlag, resolution, opts...)
+		}
 	}
-
-	// Upload the compressed metrics.
-	req, err := http.NewRequest("POST", victoriaMetricsURL()+"/api/v1/import/prometheus", &compressed)
-	if err != nil {
-		return fmt.Errorf("create request: %w", err)
+	if err := write(w, resolution, opts...); err != nil {
+		return 0, err
 	}
-	req.Header.Set("Content-Encoding", "gzip")
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("send request: %w", err)
+	if err := w.Flush(); err != nil {
+		return 0, err
 	}
-	if resp.StatusCode != http.StatusNoContent {
-		return fmt.Errorf("response status: %s", resp.Status)
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return 0, err
+		}
 	}
-	return nil
+	if f != nil {
+		if err := f.Close(); err != nil {
+			return 0, err
+		}
+	}
+	return size.Load(), nil
 }
 
-func deleteRemoteMetrics() error {
-	resp, err := http.Get(fmt.Sprintf(victoriaMetricsURL()+"/api/v1/admin/tsdb/delete_series?match[]={__name__=~\"%s.*\"}", metricsPrefix))
-	if err != nil {
-		return err
-	}
-	if resp.StatusCode != http.StatusNoContent {
-		return fmt.Errorf("response status: %s", resp.Status)
-	}
-	return nil
+// isGzipFile reports whether the file at path is compressed with gzip,
+// judging by its extension.
+func isGzipFile(path string) bool {
+	return strings.HasSuffix(path, ".gz")
 }
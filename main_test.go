@@ -0,0 +1,479 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/ngrash/tgstat/analyze"
+	"github.com/ngrash/tgstat/backfill"
+)
+
+// testMetrics returns metrics with a single recorded sample.
+func testMetrics() *backfill.Metrics {
+	metrics := backfill.NewMetrics()
+	metrics.With("sender", "Alice").Metric(analyze.MessagesTotal).Inc(1, time.Unix(1724500800, 0))
+	return metrics
+}
+
+func TestReadAndAnalyzeChatExportsCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	files := []string{"tgexport/testdata/single_chat.json", "tgexport/testdata/full_export.json"}
+	if _, err := readAndAnalyzeChatExports(ctx, files); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestReadAndAnalyzeChatExportsDedup(t *testing.T) {
+	// Message 2 is in both exports. They are not parts of the same export,
+	// which would be merged anyway, as they are not named result*.json.
+	dir := t.TempDir()
+	var files []string
+	for i, part := range []string{"result.json", "result2.json"} {
+		data, err := os.ReadFile(filepath.Join("tgexport/testdata/parts", part))
+		if err != nil {
+			t.Fatal(err)
+		}
+		file := filepath.Join(dir, fmt.Sprintf("export%d.json", i+1))
+		if err := os.WriteFile(file, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+	for _, tc := range []struct {
+		dedup bool
+		want  int
+	}{
+		{dedup: false, want: 4},
+		{dedup: true, want: 3},
+	} {
+		*dedupFlag = tc.dedup
+		t.Cleanup(func() { *dedupFlag = false })
+		result, err := readAndAnalyzeChatExports(context.Background(), files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := result.summary.Messages; got != tc.want {
+			t.Errorf("dedup=%t: got %d messages, want %d", tc.dedup, got, tc.want)
+		}
+	}
+}
+
+func TestReadAndAnalyzeChatExportsStdin(t *testing.T) {
+	f, err := os.Open("tgexport/testdata/single_chat.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	stdin = f
+	t.Cleanup(func() { stdin = os.Stdin })
+
+	result, err := readAndAnalyzeChatExports(context.Background(), []string{stdinFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := result.summary.Messages; got != 1 {
+		t.Errorf("got %d messages, want 1", got)
+	}
+	var b strings.Builder
+	if err := result.metrics.Write(&b, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if want := `file="-"`; !strings.Contains(b.String(), want) {
+		t.Errorf("missing %s in:\n%s", want, b.String())
+	}
+	if diff := cmp.Diff([]string{"Alice"}, result.chats); diff != "" {
+		t.Errorf("chats diff -want +got:\n%s", diff)
+	}
+}
+
+func TestReadAndAnalyzeChatExportsRunLabel(t *testing.T) {
+	t.Cleanup(func() { *appendTimestampFlag, *runIDFlag = false, "" })
+	start := startTime
+	t.Cleanup(func() { startTime = start })
+	startTime = time.Date(2024, 8, 24, 14, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+	files := []string{"tgexport/testdata/full_export.json"}
+
+	for _, tc := range []struct {
+		appendTimestamp bool
+		runID           string
+		want            string
+	}{
+		{appendTimestamp: true, want: `run="2024-08-24T12:00:00Z"`},
+		{runID: "nightly", want: `run="nightly"`},
+		{appendTimestamp: true, runID: "nightly", want: `run="nightly"`},
+	} {
+		*appendTimestampFlag, *runIDFlag = tc.appendTimestamp, tc.runID
+		result, err := readAndAnalyzeChatExports(context.Background(), files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b strings.Builder
+		if err := result.metrics.Write(&b, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+			if !strings.Contains(line, tc.want) {
+				t.Errorf("missing %s in %s", tc.want, line)
+			}
+		}
+	}
+
+	*appendTimestampFlag, *runIDFlag = false, ""
+	result, err := readAndAnalyzeChatExports(context.Background(), files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := result.metrics.Write(&b, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(b.String(), "run=") {
+		t.Errorf("got run label by default in:\n%s", b.String())
+	}
+}
+
+func TestReadAndAnalyzeChatExportsVerbose(t *testing.T) {
+	t.Cleanup(func() { logger = newLogger(os.Stderr, slog.LevelInfo) })
+	files := []string{"tgexport/testdata/single_chat.json"}
+	const want = `level=DEBUG msg="Analyzing file" file=tgexport/testdata/single_chat.json` + "\n"
+
+	var b strings.Builder
+	logger = newLogger(&b, slog.LevelInfo)
+	if _, err := readAndAnalyzeChatExports(context.Background(), files); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(b.String(), want) {
+		t.Errorf("got debug message without -verbose:\n%s", b.String())
+	}
+
+	b.Reset()
+	logger = newLogger(&b, slog.LevelDebug)
+	if _, err := readAndAnalyzeChatExports(context.Background(), files); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), want) {
+		t.Errorf("missing %q in:\n%s", want, b.String())
+	}
+}
+
+func TestReadAndAnalyzeChatExportsDedupSkipErrors(t *testing.T) {
+	// Message 1 is in both exports, but the first one fails after it.
+	dir := t.TempDir()
+	invalid := filepath.Join(dir, "export1.json")
+	export := `{"name": "Alice", "messages": [{"id": 1, "from": "Alice", "date_unixtime": "1724500800", "text": "Hi"}, {"id": 2, "from": "Alice"`
+	if err := os.WriteFile(invalid, []byte(export), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	valid := filepath.Join(dir, "export2.json")
+	export = `{"name": "Alice", "messages": [{"id": 1, "from": "Alice", "date_unixtime": "1724500800", "text": "Hi"}]}`
+	if err := os.WriteFile(valid, []byte(export), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	*dedupFlag = true
+	*skipErrorsFlag = true
+	*concurrencyFlag = 1
+	t.Cleanup(func() {
+		*dedupFlag = false
+		*skipErrorsFlag = false
+		*concurrencyFlag = runtime.NumCPU()
+	})
+	result, err := readAndAnalyzeChatExports(context.Background(), []string{invalid, valid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.failed) != 1 || result.failed[0].file != invalid {
+		t.Errorf("got failed %v, want %q", result.failed, invalid)
+	}
+	if got, want := result.summary.Messages, 1; got != want {
+		t.Errorf("got %d messages, want %d of %s", got, want, valid)
+	}
+}
+
+func TestReadAndAnalyzeChatExportsSkipErrors(t *testing.T) {
+	// The first message of the invalid export is analyzed before the error.
+	invalid := filepath.Join(t.TempDir(), "result.json")
+	export := `{"messages": [{"from": "Mallory", "date_unixtime": "1724500800", "text": "Hi"}, {"from": "Mallory"`
+	if err := os.WriteFile(invalid, []byte(export), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	valid := "tgexport/testdata/single_chat.json"
+	files := []string{valid, invalid, "tgexport/testdata/full_export.json"}
+
+	if _, err := readAndAnalyzeChatExports(context.Background(), files); err == nil {
+		t.Error("want error without -skip-errors")
+	}
+
+	*skipErrorsFlag = true
+	t.Cleanup(func() { *skipErrorsFlag = false })
+	result, err := readAndAnalyzeChatExports(context.Background(), files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{valid, "tgexport/testdata/full_export.json"}, result.succeeded); diff != "" {
+		t.Errorf("succeeded diff -want +got:\n%s", diff)
+	}
+	if len(result.failed) != 1 || result.failed[0].file != invalid || result.failed[0].err == nil {
+		t.Errorf("got failed %v, want %q with error", result.failed, invalid)
+	}
+
+	var b strings.Builder
+	if err := result.metrics.Write(&b, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if want := `file="` + valid + `"`; !strings.Contains(b.String(), want) {
+		t.Errorf("missing metrics of %s in:\n%s", valid, b.String())
+	}
+	if strings.Contains(b.String(), "Mallory") {
+		t.Errorf("got partial metrics of %s in:\n%s", invalid, b.String())
+	}
+	if got, want := result.summary.Messages, 4; got != want {
+		t.Errorf("got %d messages in summary, want %d of the analyzed files", got, want)
+	}
+}
+
+func TestReadAndAnalyzeChatExportsChatLabel(t *testing.T) {
+	unnamed := filepath.Join(t.TempDir(), "weirdo", "result.json")
+	if err := os.MkdirAll(filepath.Dir(unnamed), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	export := `{"messages": [{"from": "Mallory", "date_unixtime": "1724500800", "text": "Hi"}]}`
+	if err := os.WriteFile(unnamed, []byte(export), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	files := []string{"tgexport/testdata/single_chat.json", unnamed}
+
+	result, err := readAndAnalyzeChatExports(context.Background(), files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := result.metrics.Write(&b, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`tg_messages_total{chat="Alice",chat_type="personal_chat",file="tgexport/testdata/single_chat.json",sender="Alice"}`,
+		`tg_messages_total{chat="weirdo",file="` + unnamed + `",sender="Mallory"}`,
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("missing %s in:\n%s", want, b.String())
+		}
+	}
+}
+
+func TestReadAndAnalyzeChatExportsNoFileLabel(t *testing.T) {
+	*noFileLabelFlag = true
+	t.Cleanup(func() { *noFileLabelFlag = false })
+	// The chat is split into a file per sender, both with messages of Alice.
+	// Her gauges combine the messages of both files.
+	dir := t.TempDir()
+	var files []string
+	for sender, messages := range map[string]string{
+		"Alice": `{"from": "Alice", "date_unixtime": "1724500800", "text": "Hi"},
+			{"from": "Alice", "date_unixtime": "1724500800", "text": "This message has exactly forty-three runes."}`,
+		"Bob": `{"from": "Bob", "date_unixtime": "1724500800", "text": "Hi"},
+			{"from": "Alice", "date_unixtime": "1724590800", "text": "Hi"}`,
+	} {
+		export := `{"name": "Friends", "type": "private_group", "messages": [` + messages + `]}`
+		file := filepath.Join(dir, sender+".json")
+		if err := os.WriteFile(file, []byte(export), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+	slices.Sort(files)
+
+	result, err := readAndAnalyzeChatExports(context.Background(), files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := result.metrics.Write(&b, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`tg_messages_total{chat="Friends",chat_type="private_group",sender="Alice"} 3 1724590800`,
+		`tg_messages_total{chat="Friends",chat_type="private_group",sender="Bob"} 1 1724590800`,
+		`tg_sender_first_seen_timestamp{chat="Friends",chat_type="private_group",sender="Alice"} 1724500800 1724590800`,
+		`tg_sender_last_seen_timestamp{chat="Friends",chat_type="private_group",sender="Alice"} 1724590800 1724590800`,
+		`tg_sender_max_message_runes{chat="Friends",chat_type="private_group",sender="Alice"} 43 1724590800`,
+		`tg_sender_active_days_total{chat="Friends",chat_type="private_group",sender="Alice"} 2 1724590800`,
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("missing %s in:\n%s", want, b.String())
+		}
+	}
+	if strings.Contains(b.String(), "file=") {
+		t.Errorf("got file label in:\n%s", b.String())
+	}
+}
+
+func TestReadAndAnalyzeChatExportsParts(t *testing.T) {
+	files := []string{"tgexport/testdata/parts/result2.json", "tgexport/testdata/parts/result.json"}
+	result, err := readAndAnalyzeChatExports(context.Background(), files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := result.metrics.Write(&b, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	// Bob's message is in both parts, but counted once.
+	for _, want := range []string{
+		`tg_messages_total{chat="Friends",chat_type="private_group",file="tgexport/testdata/parts/result.json",sender="Alice"} 1 1724504400`,
+		`tg_messages_total{chat="Friends",chat_type="private_group",file="tgexport/testdata/parts/result.json",sender="Bob"} 1 1724504400`,
+		`tg_messages_total{chat="Friends",chat_type="private_group",file="tgexport/testdata/parts/result.json",sender="Carol"} 1 1724504400`,
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("missing %s in:\n%s", want, b.String())
+		}
+	}
+	if strings.Contains(b.String(), "result2") {
+		t.Errorf("got second part as separate export in:\n%s", b.String())
+	}
+}
+
+func TestGroupParts(t *testing.T) {
+	files := []string{
+		"a/result10.json",
+		"a/result.json",
+		"b/result.json.gz",
+		"a/result2.json",
+		"c/messages.json",
+		"-",
+	}
+	got := groupParts(files)
+	want := [][]string{
+		{"a/result.json", "a/result2.json", "a/result10.json"},
+		{"b/result.json.gz"},
+		{"c/messages.json"},
+		{"-"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
+
+func TestReadAndAnalyzeChatExportsSummary(t *testing.T) {
+	files := []string{"tgexport/testdata/single_chat.json", "tgexport/testdata/full_export.json"}
+	result, err := readAndAnalyzeChatExports(context.Background(), files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := analyze.Summary{
+		Messages: 4,
+		Senders:  3,
+		First:    time.Unix(1724500800, 0),
+		Last:     time.Unix(1724504460, 0),
+	}
+	if diff := cmp.Diff(want, result.summary); diff != "" {
+		t.Errorf("summary diff -want +got:\n%s", diff)
+	}
+	if result.series == 0 {
+		t.Error("got no series")
+	}
+}
+
+func TestWriteMetricsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.txt")
+	if _, err := writeMetrics(testMetrics(), path, "victoriametrics", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "tg_messages_total{sender=\"Alice\"} 1 1724500800\n"
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
+
+func TestWriteMetricsGzip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.txt.gz")
+	size, err := writeMetrics(testMetrics(), path, "victoriametrics", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || info.Size() != size {
+		t.Errorf("got size %d, want the compressed size of the file: %v, %v", size, info.Size(), err)
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "tg_messages_total{sender=\"Alice\"} 1 1724500800\n"
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
+
+func TestWriteMetricsJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	if _, err := writeMetrics(testMetrics(), path, "json", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[{"metric":"tg_messages_total","labels":{"sender":"Alice"},"samples":[{"t":1724500800,"v":1}]}]` + "\n"
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
+
+func TestWriteMetricsOpenMetrics(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.txt")
+	if _, err := writeMetrics(testMetrics(), path, "openmetrics", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# TYPE tg_messages_total unknown\n"
+	want += "tg_messages_total{sender=\"Alice\"} 1 1724500800\n"
+	want += "# EOF\n"
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
+
+func TestWriteMetricsInflux(t *testing.T) {
+	// A dry run writes the metrics as they would be sent, not as text.
+	path := filepath.Join(t.TempDir(), "metrics.txt")
+	if _, err := writeMetrics(testMetrics(), path, "influx", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "tgstat,sender=Alice tg_messages_total=1 1724500800000000000\n"
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
@@ -2,23 +2,210 @@
 package tgexport
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
 // Result represents the result.json file.
 type Result struct {
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
 	Messages []Message `json:"messages"`
 }
 
+// Chat represents a single chat of an export.
+// Its Name can be used to tell chats of a full export apart.
+type Chat struct {
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	Messages []Message `json:"messages"`
+
+	// Self is the account that exported the chat, or nil if the export has
+	// no personal information. Only full exports include it.
+	Self *PersonalInformation `json:"-"`
+}
+
+// PersonalInformation is the account of the user who exported the chats.
+type PersonalInformation struct {
+	UserID    int64  `json:"user_id"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Username  string `json:"username"`
+}
+
+// SenderID returns the FromID of messages sent by the account.
+func (p *PersonalInformation) SenderID() string {
+	return fmt.Sprintf("user%d", p.UserID)
+}
+
+// Name returns the name that messages sent by the account have as From.
+func (p *PersonalInformation) Name() Sender {
+	return Sender(strings.TrimSpace(p.FirstName + " " + p.LastName))
+}
+
+// fullExport represents the result.json file of an "Export all" from Telegram Desktop.
+// Single-chat exports have the fields of Chat at the top level instead of a chats list.
+type fullExport struct {
+	PersonalInformation *PersonalInformation `json:"personal_information"`
+	Chats               *struct {
+		List []Chat `json:"list"`
+	} `json:"chats"`
+	Chat
+}
+
 type Sender string
 
 type Message struct {
-	From         Sender       `json:"from"`
+	// Type is either "message" or "service". Service messages are created
+	// by Telegram, e.g. when someone joins or pins a message.
+	Type string `json:"type"`
+
+	// ID identifies the message within its chat.
+	ID int64 `json:"id"`
+
+	// Actor is the Sender that caused a service message.
+	Actor Sender `json:"actor"`
+
+	// Action is what happened in a service message, e.g. "topic_created".
+	Action string `json:"action"`
+
+	// Title is the name of the topic created by a topic_created service message.
+	Title string `json:"title"`
+
+	From Sender `json:"from"`
+
+	// FromID identifies the sender, e.g. "user123" for the user with ID 123.
+	// Unlike From, it does not change when users rename themselves.
+	FromID string `json:"from_id"`
+
+	Text         Text         `json:"text"`
 	TextEntities []TextEntity `json:"text_entities"`
 	Date         Time         `json:"date"`
+
+	// Edited is the time of the last edit, or nil if the message was not edited.
+	Edited *Time `json:"edited"`
+
+	// ReplyToID is the ID of the message this message replies to, or zero.
+	ReplyToID int64 `json:"reply_to_message_id"`
+
+	// ForwardedFrom is the original sender of a forwarded message.
+	ForwardedFrom string `json:"forwarded_from"`
+
+	// MediaType is the type of attached media, e.g. "sticker" or "voice_message".
+	// Messages with a Photo have MediaType "photo".
+	MediaType string `json:"media_type"`
+
+	// Photo is the path of an attached photo.
+	Photo string `json:"photo"`
+
+	// FileSize is the size of the attached media in bytes, or zero.
+	FileSize int64 `json:"file_size"`
+
+	// Width and Height are the dimensions of attached photos and videos.
+	Width  int `json:"width"`
+	Height int `json:"height"`
+
+	// DurationSeconds is the length of attached audio and video, e.g. of
+	// voice and video messages.
+	DurationSeconds int `json:"duration_seconds"`
+
+	Reactions []Reaction `json:"reactions"`
+
+	// Poll is the poll of the message, or nil if it has none.
+	Poll *Poll `json:"poll"`
+}
+
+// PlainText returns the concatenated text of the message.
+func (m *Message) PlainText() string {
+	var s strings.Builder
+	for _, e := range m.Text {
+		s.WriteString(e.Text)
+	}
+	return s.String()
+}
+
+// UnmarshalJSON decodes a message. The unambiguous date_unixtime and
+// edited_unixtime fields are preferred over the date and edited fields,
+// which lack a timezone.
+// Photos are not marked with a media type by Telegram, so it is set here.
+// The size of photos is stored as FileSize like that of other media.
+func (m *Message) UnmarshalJSON(b []byte) error {
+	type message Message // prevent recursion
+	var raw struct {
+		message
+		DateUnixtime   string `json:"date_unixtime"`
+		EditedUnixtime string `json:"edited_unixtime"`
+		PhotoFileSize  int64  `json:"photo_file_size"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	*m = Message(raw.message)
+	if raw.DateUnixtime != "" {
+		date, err := parseUnixtime(raw.DateUnixtime)
+		if err != nil {
+			return fmt.Errorf("date_unixtime: %w", err)
+		}
+		m.Date = date
+	}
+	if raw.EditedUnixtime != "" {
+		edited, err := parseUnixtime(raw.EditedUnixtime)
+		if err != nil {
+			return fmt.Errorf("edited_unixtime: %w", err)
+		}
+		m.Edited = &edited
+	}
+	if m.Photo != "" && m.MediaType == "" {
+		m.MediaType = "photo"
+	}
+	if m.FileSize == 0 {
+		// Photos have their own field for the size.
+		m.FileSize = raw.PhotoFileSize
+	}
+	return nil
+}
+
+// parseUnixtime parses Telegram's string encoded Unix timestamps.
+func parseUnixtime(s string) (Time, error) {
+	sec, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return Time{}, err
+	}
+	return Time(time.Unix(sec, 0).In(Location)), nil
+}
+
+// Reaction is a reaction to a message, e.g. with an emoji.
+type Reaction struct {
+	// Type is "emoji" for reactions with a unicode emoji,
+	// or e.g. "custom_emoji" for custom reactions.
+	Type  string `json:"type"`
+	Count uint64 `json:"count"`
+	Emoji string `json:"emoji"`
+}
+
+// Poll is a poll sent as a message.
+type Poll struct {
+	Question    string       `json:"question"`
+	Closed      bool         `json:"closed"`
+	TotalVoters uint64       `json:"total_voters"`
+	Answers     []PollAnswer `json:"answers"`
+}
+
+// PollAnswer is an answer option of a Poll.
+type PollAnswer struct {
+	Text   string `json:"text"`
+	Voters uint64 `json:"voters"`
+
+	// Chosen is true if the exporting user chose the answer.
+	Chosen bool `json:"chosen"`
 }
 
 type TextEntity struct {
@@ -26,6 +213,58 @@ type TextEntity struct {
 	Text string `json:"text"`
 }
 
+// Text is the text of a message. Telegram encodes it either as a plain
+// string or as an array mixing plain strings and TextEntity objects.
+type Text []TextEntity
+
+func (t *Text) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		if s == "" {
+			*t = nil
+		} else {
+			*t = Text{{Type: "plain", Text: s}}
+		}
+		return nil
+	}
+
+	var parts []json.RawMessage
+	if err := json.Unmarshal(b, &parts); err != nil {
+		return fmt.Errorf("text is neither string nor array: %w", err)
+	}
+	text := make(Text, 0, len(parts))
+	for _, p := range parts {
+		var e TextEntity
+		if err := json.Unmarshal(p, &e.Text); err == nil {
+			e.Type = "plain"
+		} else if err := json.Unmarshal(p, &e); err != nil {
+			return err
+		}
+		text = append(text, e)
+	}
+	*t = text
+	return nil
+}
+
+// Location is the time zone of parsed times. Telegram writes dates without
+// time zone in the zone of the exporting device, so they are interpreted in
+// Location. Unix timestamps are converted to Location, which determines e.g.
+// the hour of the day of a message.
+var Location = time.UTC
+
+// Layout is the layout of the date fields in an export. If a date does not
+// match Layout, a few variations such as a space instead of the T or a time
+// zone offset are tried before failing.
+var Layout = "2006-01-02T15:04:05"
+
+// fallbackLayouts are tried in order if a date does not match Layout.
+// Fractional seconds are accepted by all layouts when parsing.
+var fallbackLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04:05Z07:00",
+}
+
 type Time time.Time
 
 func (t *Time) UnmarshalJSON(b []byte) error {
@@ -33,22 +272,230 @@ func (t *Time) UnmarshalJSON(b []byte) error {
 	if err := json.Unmarshal(b, &s); err != nil {
 		return err
 	}
-	parsed, err := time.Parse("2006-01-02T15:04:05", s)
-	if err != nil {
-		return err
+	parsed, err := time.ParseInLocation(Layout, s, Location)
+	if err == nil {
+		*t = Time(parsed)
+		return nil
 	}
-	*t = Time(parsed)
-	return nil
+	for _, layout := range fallbackLayouts {
+		if fallback, ferr := time.ParseInLocation(layout, s, Location); ferr == nil {
+			*t = Time(fallback)
+			return nil
+		}
+	}
+	return err // the error for Layout is the most helpful
 }
 
 func ReadFile(path string) (*Result, error) {
-	r, err := os.Open(path)
+	f, err := os.Open(path)
 	if err != nil {
 		return nil, fmt.Errorf("open: %w", err)
 	}
+	defer f.Close()
+	return Read(f)
+}
+
+// Read reads a result.json file from r, e.g. from stdin.
+// Like files, gzip compressed data is decompressed.
+func Read(r io.Reader) (*Result, error) {
+	r, err := decompress(r)
+	if err != nil {
+		return nil, fmt.Errorf("decompress: %w", err)
+	}
 	var data Result
 	if err := json.NewDecoder(r).Decode(&data); err != nil {
 		return nil, fmt.Errorf("decode: %w", err)
 	}
 	return &data, nil
 }
+
+// ReadParts reads the result.json files at paths, which are parts of the export
+// of a single chat, e.g. result.json and result2.json, and concatenates their
+// messages in the order of paths. Messages with the same ID as an earlier
+// message are skipped, so that overlapping parts are not counted twice.
+// The name and type of the chat are those of the first part.
+func ReadParts(paths []string) (*Result, error) {
+	var merged Result
+	seen := map[int64]bool{}
+	for _, path := range paths {
+		data, err := ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if merged.Name == "" && merged.Type == "" {
+			merged.Name, merged.Type = data.Name, data.Type
+		}
+		for _, msg := range data.Messages {
+			if msg.ID != 0 {
+				if seen[msg.ID] {
+					continue
+				}
+				seen[msg.ID] = true
+			}
+			merged.Messages = append(merged.Messages, msg)
+		}
+	}
+	return &merged, nil
+}
+
+// ReadFullExport reads all chats from the result.json file at path.
+// If the file is a single-chat export, the chat is returned as the only element.
+func ReadFullExport(path string) ([]Chat, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+	defer f.Close()
+	r, err := decompress(f)
+	if err != nil {
+		return nil, fmt.Errorf("decompress: %w", err)
+	}
+	var data fullExport
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+	if data.Chats == nil {
+		return []Chat{data.Chat}, nil
+	}
+	for i := range data.Chats.List {
+		data.Chats.List[i].Self = data.PersonalInformation
+	}
+	return data.Chats.List, nil
+}
+
+// decompress returns a reader of the decompressed data of r.
+// Gzip compressed data is detected by its magic bytes, other data is read as is.
+func decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		return gzip.NewReader(br)
+	}
+	return br, nil
+}
+
+// ReadFileStream reads the messages of the result.json file at path one by one
+// and calls fn for each of them, without holding all messages in memory.
+// Both single-chat and full exports are supported.
+func ReadFileStream(path string, fn func(Message) error) error {
+	return ReadFullExportStream(path, func(_ *Chat, msg Message) error {
+		return fn(msg)
+	})
+}
+
+// ReadFullExportStream is like ReadFileStream but also passes the chat of
+// each message to fn. The Messages of the chat are always empty.
+func ReadFullExportStream(path string, fn func(*Chat, Message) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+	defer f.Close()
+	return ReadStream(f, fn)
+}
+
+// ReadStream is like ReadFullExportStream, but reads the export from r,
+// e.g. from stdin.
+func ReadStream(r io.Reader, fn func(*Chat, Message) error) error {
+	r, err := decompress(r)
+	if err != nil {
+		return fmt.Errorf("decompress: %w", err)
+	}
+
+	dec := json.NewDecoder(r)
+	chat := &Chat{} // single-chat exports have the chat at the top level
+	// Telegram writes the personal information before the chats.
+	var self *PersonalInformation
+	err = readObject(dec, func(key string) error {
+		if key == "personal_information" {
+			return dec.Decode(&self)
+		}
+		if key != "chats" {
+			return readChatField(dec, chat, key, fn)
+		}
+		return readObject(dec, func(key string) error {
+			if key != "list" {
+				return skipValue(dec)
+			}
+			return readArray(dec, func() error {
+				chat := &Chat{Self: self}
+				return readObject(dec, func(key string) error {
+					return readChatField(dec, chat, key, fn)
+				})
+			})
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+	return nil
+}
+
+// readChatField decodes the value of key into chat. The messages are passed to
+// fn one by one. Telegram writes the name and type of a chat before its
+// messages, so they are known by the time fn is called.
+func readChatField(dec *json.Decoder, chat *Chat, key string, fn func(*Chat, Message) error) error {
+	switch key {
+	case "name":
+		return dec.Decode(&chat.Name)
+	case "type":
+		return dec.Decode(&chat.Type)
+	case "messages":
+		return readArray(dec, func() error {
+			var msg Message
+			if err := dec.Decode(&msg); err != nil {
+				return err
+			}
+			return fn(chat, msg)
+		})
+	default:
+		return skipValue(dec)
+	}
+}
+
+// readObject reads a JSON object and calls fn for each key.
+// fn must consume the value of the key.
+func readObject(dec *json.Decoder, fn func(key string) error) error {
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if err := fn(t.(string)); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+// readArray reads a JSON array and calls fn for each element.
+// fn must consume the element.
+func readArray(dec *json.Decoder, fn func() error) error {
+	if err := expectDelim(dec, '['); err != nil {
+		return err
+	}
+	for dec.More() {
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, ']')
+}
+
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if got, ok := t.(json.Delim); !ok || got != want {
+		return fmt.Errorf("expected %v, got %v", want, t)
+	}
+	return nil
+}
+
+func skipValue(dec *json.Decoder) error {
+	var v json.RawMessage
+	return dec.Decode(&v)
+}
@@ -0,0 +1,386 @@
+package tgexport
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestReadFullExport(t *testing.T) {
+	chats, err := ReadFullExport("testdata/full_export.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chats) != 2 {
+		t.Fatalf("got %d chats, want 2", len(chats))
+	}
+	for i, want := range []struct {
+		name, typ string
+		messages  int
+	}{
+		{"Alice", "personal_chat", 1},
+		{"Friends", "private_group", 2},
+	} {
+		got := chats[i]
+		if got.Name != want.name || got.Type != want.typ || len(got.Messages) != want.messages {
+			t.Errorf("chat %d: got %q (%s) with %d messages, want %q (%s) with %d messages",
+				i, got.Name, got.Type, len(got.Messages), want.name, want.typ, want.messages)
+		}
+	}
+}
+
+func TestReadFullExportSelf(t *testing.T) {
+	for name, read := range map[string]func() ([]*Chat, error){
+		"ReadFullExport": func() ([]*Chat, error) {
+			chats, err := ReadFullExport("testdata/full_export_self.json")
+			var ptrs []*Chat
+			for i := range chats {
+				ptrs = append(ptrs, &chats[i])
+			}
+			return ptrs, err
+		},
+		"ReadFullExportStream": func() ([]*Chat, error) {
+			var chats []*Chat
+			err := ReadFullExportStream("testdata/full_export_self.json", func(chat *Chat, msg Message) error {
+				chats = append(chats, chat)
+				return nil
+			})
+			return chats, err
+		},
+	} {
+		chats, err := read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chats) == 0 || chats[0].Self == nil {
+			t.Fatalf("%s: got no personal information", name)
+		}
+		self := chats[0].Self
+		if got, want := self.SenderID(), "user42"; got != want {
+			t.Errorf("%s: got sender ID %q, want %q", name, got, want)
+		}
+		if got, want := self.Name(), Sender("Alice Example"); got != want {
+			t.Errorf("%s: got name %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestReadFullExportSingleChat(t *testing.T) {
+	chats, err := ReadFullExport("testdata/single_chat.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chats) != 1 {
+		t.Fatalf("got %d chats, want 1", len(chats))
+	}
+	if chats[0].Name != "Alice" || len(chats[0].Messages) != 1 {
+		t.Errorf("got %q with %d messages, want %q with 1 message", chats[0].Name, len(chats[0].Messages), "Alice")
+	}
+}
+
+func TestReadParts(t *testing.T) {
+	data, err := ReadParts([]string{"testdata/parts/result.json", "testdata/parts/result2.json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, msg := range data.Messages {
+		got = append(got, fmt.Sprintf("%d %s", msg.ID, msg.From))
+	}
+	want := []string{"1 Alice", "2 Bob", "3 Carol"} // message 2 is in both parts
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+	if data.Name != "Friends" || data.Type != "private_group" {
+		t.Errorf("got chat %q of type %q, want %q of type %q", data.Name, data.Type, "Friends", "private_group")
+	}
+}
+
+func TestTimeLocation(t *testing.T) {
+	t.Cleanup(func() { Location = time.UTC })
+
+	parse := func(zone string) Time {
+		t.Helper()
+		loc, err := time.LoadLocation(zone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		Location = loc
+		var got Time
+		if err := json.Unmarshal([]byte(`"2024-08-24T14:00:00"`), &got); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	utc := time.Time(parse("UTC"))
+	berlin := time.Time(parse("Europe/Berlin")) // CEST, UTC+2
+
+	if got, want := utc.Unix(), int64(1724508000); got != want {
+		t.Errorf("UTC: got %d, want %d", got, want)
+	}
+	if got, want := utc.Sub(berlin), 2*time.Hour; got != want {
+		t.Errorf("got difference %s, want %s", got, want)
+	}
+	if berlin.Hour() != 14 {
+		t.Errorf("got hour %d in Berlin, want 14", berlin.Hour())
+	}
+
+	var m Message
+	if err := json.Unmarshal([]byte(`{"date_unixtime": "1724508000"}`), &m); err != nil {
+		t.Fatal(err)
+	}
+	if got := time.Time(m.Date).Hour(); got != 16 {
+		t.Errorf("got hour %d of Unix timestamp in Berlin, want 16", got)
+	}
+}
+
+func TestTimeLayouts(t *testing.T) {
+	want := time.Date(2024, 8, 24, 14, 0, 0, 0, time.UTC)
+	for _, s := range []string{
+		"2024-08-24T14:00:00",
+		"2024-08-24T14:00:00.000",
+		"2024-08-24 14:00:00",
+		"2024-08-24T16:00:00+02:00",
+	} {
+		var got Time
+		if err := json.Unmarshal([]byte(`"`+s+`"`), &got); err != nil {
+			t.Errorf("%s: %v", s, err)
+			continue
+		}
+		if !time.Time(got).Equal(want) {
+			t.Errorf("%s: got %s, want %s", s, time.Time(got), want)
+		}
+	}
+
+	var got Time
+	if err := json.Unmarshal([]byte(`"24.08.2024 14:00"`), &got); err == nil {
+		t.Errorf("got %s for unknown layout, want error", time.Time(got))
+	}
+
+	t.Cleanup(func() { Layout = "2006-01-02T15:04:05" })
+	Layout = "02.01.2006 15:04"
+	if err := json.Unmarshal([]byte(`"24.08.2024 14:00"`), &got); err != nil {
+		t.Fatal(err)
+	}
+	if !time.Time(got).Equal(want) {
+		t.Errorf("custom layout: got %s, want %s", time.Time(got), want)
+	}
+}
+
+func TestMessageFileSize(t *testing.T) {
+	data, err := ReadFile("testdata/media.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, m := range data.Messages {
+		got = append(got, fmt.Sprintf("%s %d %dx%d", m.MediaType, m.FileSize, m.Width, m.Height))
+	}
+	want := []string{"photo 1000 1280x960", "video_file 2500 640x480", "photo 3000 1280x960"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
+
+func TestMessageDuration(t *testing.T) {
+	data, err := ReadFile("testdata/voice.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, m := range data.Messages {
+		got = append(got, fmt.Sprintf("%s %ds", m.MediaType, m.DurationSeconds))
+	}
+	want := []string{"voice_message 12s", "video_message 8s", "voice_message 30s"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
+
+func TestMessagePoll(t *testing.T) {
+	data, err := ReadFile("testdata/poll.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Poll{
+		Question:    "Pizza tonight?",
+		Closed:      true,
+		TotalVoters: 3,
+		Answers: []PollAnswer{
+			{Text: "Yes", Voters: 2, Chosen: true},
+			{Text: "No", Voters: 1},
+		},
+	}
+	if diff := cmp.Diff(want, data.Messages[0].Poll); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
+
+func TestMessageDateUnixtime(t *testing.T) {
+	// date is the local time in Berlin (UTC+2), date_unixtime is 12:00 UTC.
+	in := `{"date": "2024-08-24T14:00:00", "date_unixtime": "1724500800"}`
+	var m Message
+	if err := json.Unmarshal([]byte(in), &m); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := time.Time(m.Date).Unix(), int64(1724500800); got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+}
+
+func TestMessageDateFallback(t *testing.T) {
+	in := `{"date": "2024-08-24T12:00:00"}`
+	var m Message
+	if err := json.Unmarshal([]byte(in), &m); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := time.Time(m.Date).Unix(), int64(1724500800); got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+}
+
+func TestMessageEdited(t *testing.T) {
+	for _, in := range []string{
+		`{"edited": "2024-08-24T12:05:00"}`,
+		`{"edited": "2024-08-24T14:05:00", "edited_unixtime": "1724501100"}`,
+	} {
+		var m Message
+		if err := json.Unmarshal([]byte(in), &m); err != nil {
+			t.Fatal(err)
+		}
+		if m.Edited == nil {
+			t.Errorf("%s: got nil", in)
+		} else if got, want := time.Time(*m.Edited).Unix(), int64(1724501100); got != want {
+			t.Errorf("%s: got %d, want %d", in, got, want)
+		}
+	}
+
+	data, err := ReadFile("testdata/edited.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Messages[0].Edited == nil || data.Messages[1].Edited != nil {
+		t.Errorf("got edited %v and %v, want only the first message edited", data.Messages[0].Edited, data.Messages[1].Edited)
+	}
+}
+
+func TestMessageText(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"string", `{"text": "Hello world"}`, "Hello world"},
+		{"empty", `{"text": ""}`, ""},
+		{"array", `{"text": ["Hello ", {"type": "bold", "text": "world"}, "!"]}`, "Hello world!"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var m Message
+			if err := json.Unmarshal([]byte(tc.in), &m); err != nil {
+				t.Fatal(err)
+			}
+			if got := m.PlainText(); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestReadFileGzip(t *testing.T) {
+	raw, err := os.ReadFile("testdata/single_chat.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	if _, err := w.Write(raw); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "result.json.gz")
+	if err := os.WriteFile(path, compressed.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Messages) != 1 || data.Messages[0].From != "Alice" {
+		t.Errorf("got %+v, want a single message from Alice", data.Messages)
+	}
+}
+
+func TestReadFileUncompressed(t *testing.T) {
+	data, err := ReadFile("testdata/single_chat.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Messages) != 1 {
+		t.Errorf("got %d messages, want 1", len(data.Messages))
+	}
+}
+
+func TestRead(t *testing.T) {
+	data, err := Read(strings.NewReader(`{"name": "Alice", "messages": [{"from": "Alice", "text": "Hi"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Messages) != 1 || data.Messages[0].From != "Alice" {
+		t.Errorf("got %+v, want a single message from Alice", data.Messages)
+	}
+}
+
+func TestReadFileStream(t *testing.T) {
+	var calls int
+	err := ReadFileStream("testdata/single_chat.json", func(msg Message) error {
+		calls++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Errorf("got %d calls, want 1", calls)
+	}
+}
+
+func TestReadFullExportStream(t *testing.T) {
+	var got []string
+	err := ReadFullExportStream("testdata/full_export.json", func(chat *Chat, msg Message) error {
+		got = append(got, chat.Name+"/"+chat.Type+": "+string(msg.From))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"Alice/personal_chat: Alice",
+		"Friends/private_group: Bob",
+		"Friends/private_group: Carol",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
+
+func TestReadFileStreamCallbackError(t *testing.T) {
+	errStop := errors.New("stop")
+	err := ReadFileStream("testdata/full_export.json", func(msg Message) error {
+		return errStop
+	})
+	if !errors.Is(err, errStop) {
+		t.Errorf("got %v, want %v", err, errStop)
+	}
+}
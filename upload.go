@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/ngrash/tgstat/backfill"
+)
+
+// victoriaMetricsURL returns the URL of VictoriaMetrics. The -vm-url flag takes
+// precedence over the VICTORIAMETRICS_URL environment variable.
+func victoriaMetricsURL() string {
+	if *vmURLFlag != "" {
+		return *vmURLFlag
+	}
+	if url := os.Getenv("VICTORIAMETRICS_URL"); url != "" {
+		return url
+	}
+	return "http://localhost:8428"
+}
+
+// authenticate adds the credentials from the environment to the header of a
+// request to VictoriaMetrics. A bearer token is preferred over basic auth.
+// Requests to other endpoints, e.g. set with -remote-write-url, must not be
+// authenticated, as they may belong to someone else.
+func authenticate(header http.Header) {
+	if token := os.Getenv("VICTORIAMETRICS_TOKEN"); token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	} else if user := os.Getenv("VICTORIAMETRICS_USER"); user != "" {
+		credentials := user + ":" + os.Getenv("VICTORIAMETRICS_PASSWORD")
+		header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	}
+}
+
+// preflightTimeout limits the request of checkVictoriaMetrics.
+const preflightTimeout = 10 * time.Second
+
+// checkVictoriaMetrics requests the health endpoint of VictoriaMetrics at
+// vmURL and returns an error unless it responds with 200 OK.
+func checkVictoriaMetrics(ctx context.Context, vmURL string) error {
+	ctx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", vmURL+"/health", nil)
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	authenticate(req.Header)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("send request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &statusError{code: resp.StatusCode, status: resp.Status}
+	}
+	return nil
+}
+
+// uploadToVictoriaMetrics imports the metrics into VictoriaMetrics at vmURL.
+// Existing metrics of the replaced scopes are deleted before the import.
+// It returns the number of compressed bytes uploaded.
+//
+// The metrics are compressed and sent while they are written, so the payload
+// is never held in memory as a whole. Every attempt writes them again.
+func uploadToVictoriaMetrics(ctx context.Context, metrics *backfill.Metrics, vmURL string, resolution time.Duration, replace []replaceScope, opts ...backfill.WriteOption) (int64, error) {
+	return importToVictoriaMetrics(ctx, vmURL, replace, func(w io.Writer) error {
+		return metrics.Write(w, resolution, opts...)
+	})
+}
+
+// uploadFileToVictoriaMetrics is like uploadToVictoriaMetrics, but uploads
+// the metrics in the file at path, e.g. written by writeMetrics. The upload
+// is identical to the file, without writing the metrics twice. Files ending
+// in .gz are decompressed, as the upload is compressed anyway.
+func uploadFileToVictoriaMetrics(ctx context.Context, path, vmURL string, replace []replaceScope) (int64, error) {
+	return importToVictoriaMetrics(ctx, vmURL, replace, func(w io.Writer) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		var r io.Reader = f
+		if isGzipFile(path) {
+			gz, err := gzip.NewReader(f)
+			if err != nil {
+				return err
+			}
+			defer gz.Close()
+			r = gz
+		}
+		_, err = io.Copy(w, r)
+		return err
+	})
+}
+
+// importToVictoriaMetrics imports the metrics that write writes into
+// VictoriaMetrics at vmURL, after deleting the existing metrics of replace.
+// It returns the number of compressed bytes uploaded.
+func importToVictoriaMetrics(ctx context.Context, vmURL string, replace []replaceScope, write func(io.Writer) error) (int64, error) {
+	// size counts the bytes of the latest attempt.
+	var size atomic.Int64
+	body := func() io.Reader {
+		size.Store(0)
+		r, w := io.Pipe()
+		go func() {
+			gz := gzip.NewWriter(&countingWriter{w: w, n: &size})
+			err := write(gz)
+			if err != nil {
+				err = &writeError{err}
+			} else if err = gz.Close(); err != nil {
+				err = fmt.Errorf("close gzip writer: %w", err)
+			}
+			// The request closes r when it is done, even if it failed
+			// before reading everything, which ends this goroutine.
+			w.CloseWithError(err)
+		}()
+		return r
+	}
+
+	// Delete the existing metrics, unless the upload was canceled before.
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if len(replace) > 0 {
+		if err := deleteRemoteMetrics(ctx, vmURL, replace); err != nil {
+			return 0, fmt.Errorf("delete remote metrics: %w", err)
+		}
+	}
+
+	// Upload the compressed metrics.
+	header := http.Header{}
+	header.Set("Content-Encoding", "gzip")
+	authenticate(header)
+	logger.Debug("Uploading streamed metrics")
+	if err := streamWithRetry(ctx, vmURL+"/api/v1/import/prometheus", header, body); err != nil {
+		return 0, err
+	}
+	return size.Load(), nil
+}
+
+// countingWriter counts the bytes written to w in n.
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// writeError is an error from writing the metrics into a streamed request
+// body. It is not retried, because the next attempt would fail the same way.
+type writeError struct {
+	err error
+}
+
+func (e *writeError) Error() string {
+	return "write metrics: " + e.err.Error()
+}
+
+func (e *writeError) Unwrap() error {
+	return e.err
+}
+
+// replaceScope selects the series of a file for deletion, or only those of
+// a chat in the file, if chat is not empty. Without file, it selects the
+// series of the chat in all files.
+type replaceScope struct {
+	file, chat string
+}
+
+// replaceScopes returns the scopes of the given analyzed files. Exports read
+// from stdin all have the same file label, so their scopes are narrowed down
+// to the given chats of the run, instead of deleting the chats of other runs.
+// With -no-file-label, the scopes are the chats of the run.
+func replaceScopes(files, chats []string) []replaceScope {
+	var scopes []replaceScope
+	if *noFileLabelFlag {
+		for _, chat := range chats {
+			scopes = append(scopes, replaceScope{chat: chat})
+		}
+		return scopes
+	}
+	for _, file := range files {
+		if file != stdinFile {
+			scopes = append(scopes, replaceScope{file: file})
+			continue
+		}
+		for _, chat := range chats {
+			scopes = append(scopes, replaceScope{file: file, chat: chat})
+		}
+	}
+	return scopes
+}
+
+// deleteRemoteMetrics deletes all series in one of the given scopes.
+func deleteRemoteMetrics(ctx context.Context, vmURL string, scopes []replaceScope) error {
+	query := url.Values{}
+	for _, scope := range scopes {
+		selector := fmt.Sprintf("__name__=~%q", *metricsPrefixFlag+".*")
+		if scope.file != "" {
+			selector += fmt.Sprintf(",file=%q", scope.file)
+		}
+		if scope.chat != "" {
+			selector += fmt.Sprintf(",chat=%q", scope.chat)
+		}
+		query.Add("match[]", "{"+selector+"}")
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", vmURL+"/api/v1/admin/tsdb/delete_series?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	authenticate(req.Header)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Depending on the version, VictoriaMetrics answers 200 or 204, and 404
+	// if nothing matched. Either way, no matching series remain.
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	}
+	return fmt.Errorf("response status: %s", resp.Status)
+}
+
+func remoteWriteURL() string {
+	if *remoteWriteURLFlag != "" {
+		return *remoteWriteURLFlag
+	}
+	return victoriaMetricsURL() + "/api/v1/write"
+}
+
+// sendRemoteWrite sends the metrics to a Prometheus remote write endpoint.
+// Unlike uploadToVictoriaMetrics, it does not delete existing metrics first,
+// as there is no portable API for that. It returns the number of bytes sent.
+func sendRemoteWrite(ctx context.Context, metrics *backfill.Metrics, resolution time.Duration, opts ...backfill.WriteOption) (int64, error) {
+	var body bytes.Buffer
+	if err := metrics.WriteRemoteWrite(&body, resolution, opts...); err != nil {
+		return 0, fmt.Errorf("write metrics: %w", err)
+	}
+
+	header := http.Header{}
+	header.Set("Content-Encoding", "snappy")
+	header.Set("Content-Type", "application/x-protobuf")
+	header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if *remoteWriteURLFlag == "" {
+		authenticate(header)
+	}
+	if err := postWithRetry(ctx, remoteWriteURL(), header, body.Bytes()); err != nil {
+		return 0, err
+	}
+	return int64(body.Len()), nil
+}
+
+func influxURL() string {
+	if *influxURLFlag != "" {
+		return *influxURLFlag
+	}
+	return victoriaMetricsURL() + "/write"
+}
+
+// sendInflux sends the metrics to an InfluxDB compatible write endpoint.
+// Like sendRemoteWrite, it does not delete existing metrics first and returns
+// the number of bytes sent.
+func sendInflux(ctx context.Context, metrics *backfill.Metrics, measurement string, resolution time.Duration, opts ...backfill.WriteOption) (int64, error) {
+	var body bytes.Buffer
+	if err := metrics.WriteInflux(&body, measurement, resolution, opts...); err != nil {
+		return 0, fmt.Errorf("write metrics: %w", err)
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	if *influxURLFlag == "" {
+		authenticate(header)
+	}
+	if err := postWithRetry(ctx, influxURL(), header, body.Bytes()); err != nil {
+		return 0, err
+	}
+	return int64(body.Len()), nil
+}
+
+// sendGraphite sends the metrics to a Carbon receiver at address over TCP.
+// The plaintext protocol has no responses, so failures are not retried.
+// It returns the number of bytes sent.
+func sendGraphite(ctx context.Context, metrics *backfill.Metrics, address string, resolution time.Duration, opts ...backfill.WriteOption) (int64, error) {
+	var body bytes.Buffer
+	if err := metrics.WriteGraphite(&body, *metricsPrefixFlag, resolution, opts...); err != nil {
+		return 0, fmt.Errorf("write metrics: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, *uploadTimeoutFlag)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return 0, fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	logger.Debug("Uploading", "bytes", body.Len())
+	n, err := body.WriteTo(conn)
+	if err != nil {
+		return n, fmt.Errorf("send: %w", err)
+	}
+	return n, nil
+}
+
+// retryBackoff is the time to wait before the first retry of an upload.
+// It doubles with every retry.
+var retryBackoff = 1 * time.Second
+
+// postWithRetry posts body to url. Network errors and 5xx responses are
+// retried up to -upload-retries times with exponential backoff and jitter,
+// unless ctx is done.
+func postWithRetry(ctx context.Context, url string, header http.Header, body []byte) error {
+	logger.Debug("Uploading", "bytes", len(body))
+	return streamWithRetry(ctx, url, header, func() io.Reader { return bytes.NewReader(body) })
+}
+
+// streamWithRetry is like postWithRetry, but calls body for a new request body
+// on every attempt.
+func streamWithRetry(ctx context.Context, url string, header http.Header, body func() io.Reader) error {
+	backoff := retryBackoff
+	for retry := 0; ; retry++ {
+		err := post(ctx, url, header, body())
+		if err == nil {
+			return nil
+		}
+		var (
+			status *statusError
+			write  *writeError
+		)
+		if errors.As(err, &status) && status.code < 500 || errors.As(err, &write) || retry >= *uploadRetriesFlag || ctx.Err() != nil {
+			return err
+		}
+
+		wait := backoff + rand.N(backoff)
+		logger.Warn("Upload failed, retrying", "err", err, "wait", wait.Round(time.Millisecond))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// post sends a single POST request, limited by -upload-timeout.
+func post(ctx context.Context, url string, header http.Header, body io.Reader) error {
+	ctx, cancel := context.WithTimeout(ctx, *uploadTimeoutFlag)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, body)
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header = header.Clone()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("send request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return &statusError{code: resp.StatusCode, status: resp.Status}
+	}
+	return nil
+}
+
+// statusError is returned for responses with an unexpected status code.
+type statusError struct {
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string {
+	return "response status: " + e.status
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/ngrash/tgstat/analyze"
+	"github.com/ngrash/tgstat/backfill"
+)
+
+// recordingServer starts a VictoriaMetrics stand-in that records the requests
+// it receives and responds with 204 No Content. It returns the server's URL
+// and the recorded requests.
+func recordingServer(t *testing.T) (string, *[]*http.Request) {
+	t.Helper()
+	var (
+		mu       sync.Mutex
+		requests []*http.Request
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r)
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, &requests
+}
+
+func TestUploadToVictoriaMetricsAuth(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{
+			name: "none",
+			want: "",
+		},
+		{
+			name: "basic",
+			env:  map[string]string{"VICTORIAMETRICS_USER": "alice", "VICTORIAMETRICS_PASSWORD": "secret"},
+			want: "Basic YWxpY2U6c2VjcmV0",
+		},
+		{
+			name: "token",
+			env:  map[string]string{"VICTORIAMETRICS_TOKEN": "secret"},
+			want: "Bearer secret",
+		},
+		{
+			name: "token preferred",
+			env:  map[string]string{"VICTORIAMETRICS_USER": "alice", "VICTORIAMETRICS_PASSWORD": "secret", "VICTORIAMETRICS_TOKEN": "secret"},
+			want: "Bearer secret",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+			vmURL, requests := recordingServer(t)
+
+			if _, err := uploadToVictoriaMetrics(context.Background(), testMetrics(), vmURL, time.Hour, []replaceScope{{file: "result.json"}}); err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, r := range *requests {
+				got = append(got, r.Header.Get("Authorization"))
+			}
+			want := []string{tc.want, tc.want} // delete and import
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("Authorization headers diff -want +got:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSendAuthOnlyToVictoriaMetrics(t *testing.T) {
+	t.Cleanup(func() {
+		*vmURLFlag = ""
+		*remoteWriteURLFlag = ""
+		*influxURLFlag = ""
+	})
+	t.Setenv("VICTORIAMETRICS_TOKEN", "secret")
+
+	for _, tc := range []struct {
+		name string
+		send func(ctx context.Context, metrics *backfill.Metrics) error
+		flag *string
+	}{
+		{
+			name: "remote write",
+			send: func(ctx context.Context, metrics *backfill.Metrics) error {
+				_, err := sendRemoteWrite(ctx, metrics, time.Hour)
+				return err
+			},
+			flag: remoteWriteURLFlag,
+		},
+		{
+			name: "influx",
+			send: func(ctx context.Context, metrics *backfill.Metrics) error {
+				_, err := sendInflux(ctx, metrics, "tg", time.Hour)
+				return err
+			},
+			flag: influxURLFlag,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// The default endpoint is part of VictoriaMetrics.
+			vmURL, requests := recordingServer(t)
+			*vmURLFlag = vmURL
+			*tc.flag = ""
+			if err := tc.send(context.Background(), testMetrics()); err != nil {
+				t.Fatal(err)
+			}
+			// An endpoint set with a flag may be someone else's.
+			otherURL, otherRequests := recordingServer(t)
+			*tc.flag = otherURL
+			if err := tc.send(context.Background(), testMetrics()); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := (*requests)[0].Header.Get("Authorization"); got != "Bearer secret" {
+				t.Errorf("got Authorization %q for VictoriaMetrics, want %q", got, "Bearer secret")
+			}
+			if got := (*otherRequests)[0].Header.Get("Authorization"); got != "" {
+				t.Errorf("got Authorization %q for %s, want none", got, otherURL)
+			}
+		})
+	}
+}
+
+func TestUploadToVictoriaMetricsReplace(t *testing.T) {
+	vmURL, requests := recordingServer(t)
+
+	files := replaceScopes([]string{"a/result.json", "b/result.json"}, nil)
+	if _, err := uploadToVictoriaMetrics(context.Background(), testMetrics(), vmURL, time.Hour, files); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*requests) != 2 {
+		t.Fatalf("got %d requests, want 2", len(*requests))
+	}
+	del := (*requests)[0]
+	if del.URL.Path != "/api/v1/admin/tsdb/delete_series" {
+		t.Errorf("got path %q, want delete_series", del.URL.Path)
+	}
+	want := []string{
+		`{__name__=~"tg_.*",file="a/result.json"}`,
+		`{__name__=~"tg_.*",file="b/result.json"}`,
+	}
+	if diff := cmp.Diff(want, del.URL.Query()["match[]"]); diff != "" {
+		t.Errorf("match[] diff -want +got:\n%s", diff)
+	}
+	if del.URL.Query().Has("start") || del.URL.Query().Has("end") {
+		t.Errorf("got time window %q without -since and -until", del.URL.RawQuery)
+	}
+}
+
+func TestUploadToVictoriaMetricsReplaceMetricsPrefix(t *testing.T) {
+	vmURL, requests := recordingServer(t)
+	*metricsPrefixFlag = "alice_"
+	t.Cleanup(func() { *metricsPrefixFlag = analyze.MetricsPrefix })
+
+	if _, err := uploadToVictoriaMetrics(context.Background(), testMetrics(), vmURL, time.Hour, []replaceScope{{file: "result.json"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{`{__name__=~"alice_.*",file="result.json"}`}
+	if diff := cmp.Diff(want, (*requests)[0].URL.Query()["match[]"]); diff != "" {
+		t.Errorf("match[] diff -want +got:\n%s", diff)
+	}
+}
+
+func TestUploadToVictoriaMetricsReplaceStdin(t *testing.T) {
+	vmURL, requests := recordingServer(t)
+
+	replace := replaceScopes([]string{"a/result.json", stdinFile}, []string{"Alice", "Friends"})
+	if _, err := uploadToVictoriaMetrics(context.Background(), testMetrics(), vmURL, time.Hour, replace); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		`{__name__=~"tg_.*",file="a/result.json"}`,
+		`{__name__=~"tg_.*",file="-",chat="Alice"}`,
+		`{__name__=~"tg_.*",file="-",chat="Friends"}`,
+	}
+	if diff := cmp.Diff(want, (*requests)[0].URL.Query()["match[]"]); diff != "" {
+		t.Errorf("match[] diff -want +got:\n%s", diff)
+	}
+}
+
+func TestUploadToVictoriaMetricsReplaceNoFileLabel(t *testing.T) {
+	vmURL, requests := recordingServer(t)
+	*noFileLabelFlag = true
+	t.Cleanup(func() { *noFileLabelFlag = false })
+
+	replace := replaceScopes([]string{"a/result.json", "b/result.json"}, []string{"Friends"})
+	if _, err := uploadToVictoriaMetrics(context.Background(), testMetrics(), vmURL, time.Hour, replace); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{`{__name__=~"tg_.*",chat="Friends"}`}
+	if diff := cmp.Diff(want, (*requests)[0].URL.Query()["match[]"]); diff != "" {
+		t.Errorf("match[] diff -want +got:\n%s", diff)
+	}
+}
+
+func TestRunReplaceTimeWindow(t *testing.T) {
+	configFile := *configFileFlag
+	t.Cleanup(func() {
+		*configFileFlag, *replaceFlag = configFile, false
+		sinceFlag = timeFlag{}
+	})
+	*configFileFlag = filepath.Join(t.TempDir(), "config.json")
+	*replaceFlag = true
+	sinceFlag.Time = time.Unix(1724500800, 0)
+
+	err := run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "replace is not supported with since or until") {
+		t.Errorf("got %v, want error about replace with since", err)
+	}
+}
+
+func TestUploadToVictoriaMetricsCanceled(t *testing.T) {
+	vmURL, requests := recordingServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := uploadToVictoriaMetrics(ctx, testMetrics(), vmURL, time.Hour, []replaceScope{{file: "result.json"}})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+	// Most importantly, nothing is deleted.
+	if len(*requests) != 0 {
+		t.Errorf("got %d requests, want none", len(*requests))
+	}
+}
+
+func TestUploadToVictoriaMetricsNoReplace(t *testing.T) {
+	vmURL, requests := recordingServer(t)
+
+	if _, err := uploadToVictoriaMetrics(context.Background(), testMetrics(), vmURL, time.Hour, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*requests) != 1 || (*requests)[0].URL.Path != "/api/v1/import/prometheus" {
+		t.Errorf("want only the import request, got %d requests", len(*requests))
+	}
+}
+
+func TestUploadToVictoriaMetricsRetry(t *testing.T) {
+	retryBackoff = time.Millisecond
+	t.Cleanup(func() { retryBackoff = time.Second })
+
+	var attempts int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	if _, err := uploadToVictoriaMetrics(context.Background(), testMetrics(), srv.URL, time.Hour, nil); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 3 {
+		t.Errorf("got %d attempts, want 3", attempts)
+	}
+}
+
+func TestUploadToVictoriaMetricsNoRetryOnClientError(t *testing.T) {
+	retryBackoff = time.Millisecond
+	t.Cleanup(func() { retryBackoff = time.Second })
+
+	var attempts int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	if _, err := uploadToVictoriaMetrics(context.Background(), testMetrics(), srv.URL, time.Hour, nil); err == nil {
+		t.Fatal("want error")
+	}
+	if attempts != 1 {
+		t.Errorf("got %d attempts, want 1", attempts)
+	}
+}
+
+func TestUploadToVictoriaMetricsStreaming(t *testing.T) {
+	metrics := backfill.NewMetrics()
+	start := time.Unix(1724500800, 0)
+	const senders, hours = 10, 24 * 365
+	for s := range senders {
+		m := metrics.With("sender", fmt.Sprint("sender", s)).Metric(analyze.MessagesTotal)
+		for h := range hours {
+			m.Inc(1, start.Add(time.Duration(h)*time.Hour))
+		}
+	}
+
+	var lines int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength != -1 {
+			t.Errorf("got content length %d, want a streamed body", r.ContentLength)
+		}
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Error(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		sc := bufio.NewScanner(gz)
+		for sc.Scan() {
+			lines++
+		}
+		if err := sc.Err(); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	if _, err := uploadToVictoriaMetrics(context.Background(), metrics, srv.URL, time.Hour, nil); err != nil {
+		t.Fatal(err)
+	}
+	if want := senders * hours; lines != want {
+		t.Errorf("got %d lines, want %d", lines, want)
+	}
+}
+
+func TestDeleteRemoteMetricsStatus(t *testing.T) {
+	for _, tt := range []struct {
+		status  int
+		wantErr bool
+	}{
+		{http.StatusOK, false},
+		{http.StatusNoContent, false},
+		{http.StatusNotFound, false},
+		{http.StatusBadRequest, true},
+		{http.StatusInternalServerError, true},
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+		}))
+		err := deleteRemoteMetrics(context.Background(), srv.URL, []replaceScope{{file: "result.json"}})
+		srv.Close()
+		if gotErr := err != nil; gotErr != tt.wantErr {
+			t.Errorf("status %d: got error %v, want error %t", tt.status, err, tt.wantErr)
+		}
+	}
+}
+
+func TestUploadFileToVictoriaMetrics(t *testing.T) {
+	var uploaded []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gz, err := gzip.NewReader(r.Body)
+		if err == nil {
+			uploaded, err = io.ReadAll(gz)
+		}
+		if err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "metrics.txt")
+	if _, err := writeMetrics(testMetrics(), path, "victoriametrics", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := uploadFileToVictoriaMetrics(context.Background(), path, srv.URL, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	written, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(written) == 0 {
+		t.Fatal("no metrics written")
+	}
+	if diff := cmp.Diff(string(written), string(uploaded)); diff != "" {
+		t.Errorf("diff -written +uploaded:\n%s", diff)
+	}
+}
+
+func TestUploadToVictoriaMetricsSize(t *testing.T) {
+	var received int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, err := io.Copy(io.Discard, r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		received = n
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	size, err := uploadToVictoriaMetrics(context.Background(), testMetrics(), srv.URL, time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size == 0 || size != received {
+		t.Errorf("got size %d, want the %d compressed bytes received", size, received)
+	}
+}
+
+func TestUploadFileToVictoriaMetricsGzip(t *testing.T) {
+	var uploaded []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gz, err := gzip.NewReader(r.Body)
+		if err == nil {
+			uploaded, err = io.ReadAll(gz)
+		}
+		if err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "metrics.txt.gz")
+	if _, err := writeMetrics(testMetrics(), path, "victoriametrics", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := uploadFileToVictoriaMetrics(context.Background(), path, srv.URL, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "tg_messages_total{sender=\"Alice\"} 1 1724500800\n"
+	if diff := cmp.Diff(want, string(uploaded)); diff != "" {
+		t.Errorf("diff -want +uploaded:\n%s", diff)
+	}
+}
+
+func TestSendGraphite(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	received := make(chan string)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(received)
+			return
+		}
+		defer conn.Close()
+		b, _ := io.ReadAll(conn)
+		received <- string(b)
+	}()
+
+	if _, err := sendGraphite(context.Background(), testMetrics(), l.Addr().String(), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	want := "tg.messages_total.sender.Alice 1 1724500800\n"
+	if diff := cmp.Diff(want, <-received); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+}
+
+func TestVictoriaMetricsURL(t *testing.T) {
+	t.Cleanup(func() { *vmURLFlag = "" })
+
+	for _, tc := range []struct {
+		name, flag, env, want string
+	}{
+		{name: "default", want: "http://localhost:8428"},
+		{name: "env", env: "http://env:8428", want: "http://env:8428"},
+		{name: "flag", flag: "http://flag:8428", env: "http://env:8428", want: "http://flag:8428"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			*vmURLFlag = tc.flag
+			t.Setenv("VICTORIAMETRICS_URL", tc.env)
+			if got := victoriaMetricsURL(); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRunPreflight(t *testing.T) {
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(srv.Close)
+
+	configFile, exports := *configFileFlag, *chatExportsGlob
+	t.Cleanup(func() {
+		*configFileFlag, *chatExportsGlob, *vmURLFlag = configFile, exports, ""
+		logger = newLogger(os.Stderr, slog.LevelInfo)
+	})
+	*configFileFlag = filepath.Join(t.TempDir(), "config.json")
+	*chatExportsGlob = "tgexport/testdata/single_chat.json"
+	*vmURLFlag = srv.URL
+	var b strings.Builder
+	logger = newLogger(&b, slog.LevelInfo)
+
+	var status *statusError
+	if err := run(context.Background()); !errors.As(err, &status) || status.code != http.StatusServiceUnavailable {
+		t.Fatalf("got %v, want %d", err, http.StatusServiceUnavailable)
+	}
+	if diff := cmp.Diff([]string{"/health"}, paths); diff != "" {
+		t.Errorf("diff -want +got:\n%s", diff)
+	}
+	if strings.Contains(b.String(), "Analyzed messages") {
+		t.Errorf("got analysis before failed preflight:\n%s", b.String())
+	}
+}